@@ -0,0 +1,518 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 访问密码（可选）：设置密码后，所有页面、API 和 /ws 都需要先登录，
+// 或使用扫码配对得到的设备凭据（见 pairing.go）。
+//
+// 密码只保存 PBKDF2-SHA256 哈希，与会话签名密钥一起保存在 AuthFile 中。
+// 登录成功后下发签名的会话 Cookie（内容为过期时间和角色，HMAC-SHA256 签名），
+// 服务器不保存会话；修改密码后签名密钥随之变化，旧会话全部失效。
+// 开启 -auth-skip-lan 后，通过 IP 地址直接从局域网访问的请求不需要登录；
+// 经过代理转发（带有公网 X-Forwarded-For 等请求头）或通过域名访问的请求仍需登录。
+
+const (
+	AuthFile = "auth.json"
+
+	sessionCookieName = "lan_session"
+
+	// 通过设备凭据访问时，凭据ID保存在请求上下文中
+	credentialContextKey = "credential_id"
+
+	passwordHashIterations = 200000
+	minPasswordLength      = 4
+
+	// 同一 IP 连续登录失败达到次数后，在一段时间内拒绝登录；
+	// 每次锁定的时间是上一次的两倍，最长 maxLoginLockout，超过这么久没有再锁定时重新计算
+	maxLoginFailures = 5
+	loginLockout     = time.Minute
+	maxLoginLockout  = time.Hour
+
+	// 所有来源合计每分钟超过这么多次登录尝试后，之后的尝试逐个排队并延迟校验，
+	// 限制换 IP 猜测密码的速度（每次校验都是一次 PBKDF2 计算）。只延迟不拒绝，避免管理员被他人的尝试锁在门外
+	maxLoginAttemptsPerWindow = 60
+	loginAttemptWindow        = time.Minute
+	loginThrottleDelay        = time.Second
+)
+
+var (
+	errPasswordTooShort = fmt.Errorf("密码至少需要 %d 个字符", minPasswordLength)
+	errLoginLocked      = errors.New("登录失败次数过多，请稍后再试")
+)
+
+var (
+	// -auth-skip-lan：局域网内通过 IP 直接访问时免登录
+	authSkipLAN = false
+	// -session-ttl：登录会话的有效期
+	loginSessionTTL = 30 * 24 * time.Hour
+
+	// -trusted-proxies：只有来自这些地址的 X-Forwarded-For 等请求头才会被采信；默认不信任任何代理
+	trustedProxies []string
+)
+
+// 未设置 -trusted-proxies 却收到代理转发的登录请求时只提示一次
+var untrustedProxyWarning sync.Once
+
+type authConfig struct {
+	PasswordHash string `json:"password_hash,omitempty"`
+	Secret       string `json:"secret"`
+}
+
+// 会话 Cookie 中签名的内容
+type sessionClaims struct {
+	Expires int64  `json:"exp"`
+	Nonce   string `json:"n"`
+	Role    Role   `json:"r,omitempty"` // 旧版本签发的会话没有角色，视为 editor
+}
+
+type loginFailure struct {
+	count       int
+	lockouts    int // 连续被锁定的次数，决定下一次锁定的时长
+	lockedUntil time.Time
+}
+
+// 第 n 次锁定的时长：loginLockout 每次翻倍，最长 maxLoginLockout
+func loginLockoutFor(lockouts int) time.Duration {
+	d := loginLockout
+	for i := 1; i < lockouts && d < maxLoginLockout; i++ {
+		d *= 2
+	}
+	if d > maxLoginLockout {
+		d = maxLoginLockout
+	}
+	return d
+}
+
+type authManager struct {
+	mu       sync.RWMutex
+	path     string
+	config   authConfig
+	failures map[string]*loginFailure
+
+	// 全局登录尝试计数（固定时间窗口），超过限制后的尝试通过 throttle 逐个校验
+	windowStart    time.Time
+	windowAttempts int
+	throttle       chan struct{}
+}
+
+func newAuthManager(path string) (*authManager, error) {
+	a := &authManager{path: path, failures: make(map[string]*loginFailure), throttle: make(chan struct{}, 1)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &a.config); err != nil {
+			return nil, err
+		}
+	}
+	if a.config.Secret == "" {
+		a.config.Secret = randomHex(32)
+		if err := a.saveLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// 密码和签名密钥只有本进程用户可读
+func (a *authManager) saveLocked() error {
+	data, err := json.MarshalIndent(a.config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.path, data, 0600)
+}
+
+// 是否设置了访问密码
+func (a *authManager) Enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.config.PasswordHash != ""
+}
+
+// 设置访问密码，为空时取消密码。同时更换签名密钥，使已有会话失效
+func (a *authManager) SetPassword(password string) error {
+	hash := ""
+	if password != "" {
+		if len([]rune(password)) < minPasswordLength {
+			return errPasswordTooShort
+		}
+		var err error
+		if hash, err = hashPassword(password); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.config.PasswordHash = hash
+	a.config.Secret = randomHex(32)
+	return a.saveLocked()
+}
+
+// 校验密码，同一 IP 连续失败过多时返回 errLoginLocked；
+// 所有来源的尝试次数超过限制时不拒绝，而是排队延迟校验
+func (a *authManager) CheckPassword(password, ip string) (bool, error) {
+	a.mu.Lock()
+	now := time.Now()
+	f, ok := a.failures[ip]
+	if !ok || (!f.lockedUntil.IsZero() && now.Sub(f.lockedUntil) > maxLoginLockout) {
+		f = &loginFailure{}
+		a.failures[ip] = f
+	}
+	if now.Before(f.lockedUntil) {
+		a.mu.Unlock()
+		return false, errLoginLocked
+	}
+	// 校验前先计为失败，成功后再清除，同一 IP 的并发请求也不能绕过锁定
+	f.count++
+	if f.count >= maxLoginFailures {
+		f.count = 0
+		f.lockouts++
+		lockout := loginLockoutFor(f.lockouts)
+		f.lockedUntil = now.Add(lockout)
+		log.Printf("⚠️ %s 登录失败次数过多，锁定 %v", ip, lockout)
+	}
+	if now.Sub(a.windowStart) >= loginAttemptWindow {
+		a.windowStart = now
+		a.windowAttempts = 0
+	}
+	a.windowAttempts++
+	throttled := a.windowAttempts > maxLoginAttemptsPerWindow
+	hash := a.config.PasswordHash
+	a.mu.Unlock()
+
+	if throttled {
+		a.throttle <- struct{}{}
+		time.Sleep(loginThrottleDelay)
+	}
+	ok = hash != "" && verifyPassword(hash, password)
+	if throttled {
+		<-a.throttle
+	}
+
+	if ok {
+		a.mu.Lock()
+		delete(a.failures, ip)
+		a.mu.Unlock()
+	}
+	return ok, nil
+}
+
+// 密码哈希格式：pbkdf2-sha256$迭代次数$盐$哈希（盐和哈希为 base64）
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func (a *authManager) sign(payload []byte) []byte {
+	a.mu.RLock()
+	mac := hmac.New(sha256.New, []byte(a.config.Secret))
+	a.mu.RUnlock()
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// 生成会话 Cookie 的值：base64(内容).base64(签名)
+func (a *authManager) NewSession(role Role) (string, time.Time) {
+	expires := time.Now().Add(loginSessionTTL)
+	payload, _ := json.Marshal(sessionClaims{Expires: expires.Unix(), Nonce: randomHex(8), Role: role})
+	value := base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(a.sign(payload))
+	return value, expires
+}
+
+// 校验会话 Cookie 的签名和有效期，有效时返回其中的内容
+func (a *authManager) ValidSession(value string) (sessionClaims, bool) {
+	var claims sessionClaims
+	encodedPayload, encodedSig, ok := strings.Cut(value, ".")
+	if !ok {
+		return claims, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return claims, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, a.sign(payload)) {
+		return claims, false
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, false
+	}
+	if claims.Role == "" {
+		claims.Role = RoleEditor
+	}
+	return claims, time.Now().Unix() < claims.Expires
+}
+
+// 请求带有的有效会话，没有时返回 false
+func (a *authManager) Session(c *gin.Context) (sessionClaims, bool) {
+	value, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		return sessionClaims{}, false
+	}
+	return a.ValidSession(value)
+}
+
+// 请求是否带有有效的会话 Cookie
+func (a *authManager) Authenticated(c *gin.Context) bool {
+	_, ok := a.Session(c)
+	return ok
+}
+
+func isLocalIP(ip net.IP) bool {
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// 是否为局域网内直接访问：Host 必须是 IP 地址（或 localhost），
+// 连接来源以及所有转发请求头中的地址都必须是局域网或本机地址
+func isLANRequest(c *gin.Context) bool {
+	host := c.Request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host != "localhost" && net.ParseIP(strings.Trim(host, "[]")) == nil {
+		return false
+	}
+
+	remote := c.Request.RemoteAddr
+	if h, _, err := net.SplitHostPort(remote); err == nil {
+		remote = h
+	}
+	if !isLocalIP(net.ParseIP(remote)) {
+		return false
+	}
+
+	for _, header := range []string{"X-Forwarded-For", "X-Real-IP", "CF-Connecting-IP", "True-Client-IP"} {
+		for _, value := range c.Request.Header.Values(header) {
+			for _, ip := range strings.Split(value, ",") {
+				if ip = strings.TrimSpace(ip); ip != "" && !isLocalIP(net.ParseIP(ip)) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// 不需要登录的路径
+func authExempt(path string) bool {
+	return path == "/login" || path == "/logout" || path == "/api/login" ||
+		path == "/pair" || path == "/api/pair" || strings.HasPrefix(path, "/static/")
+}
+
+// 访问控制中间件：未设置密码时不做登录检查，所有请求使用 guestRole。
+// 依次接受会话 Cookie、设备凭据和局域网免登录，并在上下文中记录请求方的角色
+func authMiddleware(c *gin.Context) {
+	if !auth.Enabled() || authExempt(c.Request.URL.Path) {
+		c.Set(roleContextKey, string(guestRole))
+		c.Next()
+		return
+	}
+	if claims, ok := auth.Session(c); ok {
+		c.Set(roleContextKey, string(claims.Role))
+		c.Next()
+		return
+	}
+	if cred, ok := requestDeviceCredential(c); ok {
+		c.Set(credentialContextKey, cred.ID)
+		c.Set(roleContextKey, string(cred.Role))
+		c.Next()
+		return
+	}
+	if authSkipLAN && isLANRequest(c) {
+		c.Set(roleContextKey, string(guestRole))
+		c.Next()
+		return
+	}
+
+	// 浏览器打开页面时跳转到登录页，API 和 WebSocket 返回 401
+	if c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Redirect(http.StatusFound, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"success": false, "error": "需要登录", "login_url": "/login"})
+}
+
+// 设置了密码时不允许跨域访问 API，防止局域网内浏览器打开的其他网页借用登录 Cookie 或局域网免登录读写数据。
+// 同源请求不受影响（cors 中间件会直接放行）
+func allowCORSOrigin(origin string) bool {
+	return !auth.Enabled()
+}
+
+// 设置了密码时，WebSocket 只接受同源页面发起的连接，防止其他网站借用登录 Cookie
+func checkWebSocketOrigin(r *http.Request) bool {
+	if !auth.Enabled() {
+		return true // 允许跨域
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// 登录后跳转的地址，只允许本站路径
+func safeNextURL(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func setSessionCookie(c *gin.Context, value string, expires time.Time) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	maxAge := int(time.Until(expires).Seconds())
+	if value == "" {
+		maxAge = -1
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// 登录页面
+func loginPageHandler(c *gin.Context) {
+	next := safeNextURL(c.Query("next"))
+	if !auth.Enabled() || auth.Authenticated(c) {
+		c.Redirect(http.StatusFound, next)
+		return
+	}
+	c.HTML(http.StatusOK, "login.html", gin.H{"next": next})
+}
+
+// 登录：表单提交时跳转，JSON 请求返回 JSON
+func loginHandler(c *gin.Context) {
+	jsonRequest := c.ContentType() == "application/json"
+	var requestData struct {
+		Password string `json:"password" form:"password"`
+		Next     string `json:"next" form:"next"`
+	}
+	if err := c.ShouldBind(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+	next := safeNextURL(requestData.Next)
+
+	fail := func(status int, message string) {
+		if jsonRequest {
+			c.JSON(status, gin.H{"success": false, "error": message})
+			return
+		}
+		c.HTML(status, "login.html", gin.H{"next": next, "error": message})
+	}
+
+	if !auth.Enabled() {
+		fail(http.StatusBadRequest, "未设置访问密码，无需登录")
+		return
+	}
+	if len(trustedProxies) == 0 && c.GetHeader("X-Forwarded-For") != "" {
+		untrustedProxyWarning.Do(func() {
+			log.Printf("⚠️ 登录请求经过了反向代理 (%s)，但没有设置 -trusted-proxies，经过代理的所有设备将共用同一个登录失败计数", c.ClientIP())
+		})
+	}
+	ok, err := auth.CheckPassword(requestData.Password, c.ClientIP())
+	if errors.Is(err, errLoginLocked) {
+		fail(http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if !ok {
+		log.Printf("⚠️ 登录失败: %s", c.ClientIP())
+		fail(http.StatusUnauthorized, "密码错误")
+		return
+	}
+
+	value, expires := auth.NewSession(RoleEditor)
+	setSessionCookie(c, value, expires)
+	log.Printf("🔓 登录成功: %s", c.ClientIP())
+
+	if jsonRequest {
+		c.JSON(http.StatusOK, gin.H{"success": true, "role": RoleEditor, "expires_at": expires.In(time.Local).Format("2006-01-02 15:04:05")})
+		return
+	}
+	c.Redirect(http.StatusFound, next)
+}
+
+// 退出登录
+func logoutHandler(c *gin.Context) {
+	setSessionCookie(c, "", time.Unix(0, 0))
+	if c.ContentType() == "application/json" {
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
+	}
+	c.Redirect(http.StatusFound, "/login")
+}
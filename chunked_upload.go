@@ -0,0 +1,700 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 分片断点续传
+//
+// POST   /uploads                        创建上传任务 {"filename","size","chunk_size","sha256"}
+// GET    /uploads/:id                    查询任务状态（已收到/缺失的分片），用于断线后续传
+// PUT    /uploads/:id/chunks/:index      上传一个分片，请求体为分片原始数据，
+//                                        必须带 X-Chunk-Checksum: sha256=<hex> 或 crc32=<hex>
+// POST   /uploads/:id/complete           所有分片到齐后合并为共享文件并广播
+// DELETE /uploads/:id                    取消上传
+//
+// 任务状态和分片数据都保存在上传目录的 .chunked 子目录中，服务器重启后仍可继续上传。
+
+const (
+	defaultChunkSize = 4 * 1024 * 1024
+	minChunkSize     = 64 * 1024
+	maxChunkSize     = 16 * 1024 * 1024
+
+	// 单个任务最多的分片数，分片过多时自动增大分片大小，避免状态占用过多内存
+	maxUploadChunks = 4096
+
+	// 超过这么久没有新分片的任务会被清理
+	chunkedUploadTTL = 24 * time.Hour
+
+	// 进度广播的最小间隔
+	uploadProgressInterval = time.Second
+)
+
+var (
+	errUploadNotFound   = errors.New("上传任务不存在")
+	errUploadIncomplete = errors.New("分片未全部上传")
+	errUploadCompleting = errors.New("上传任务正在合并")
+	errChunkOutOfRange  = errors.New("分片序号超出范围")
+	errChunkSize        = errors.New("分片大小不正确")
+	errChunkChecksum    = errors.New("分片校验失败")
+	errFileChecksum     = errors.New("文件校验失败")
+)
+
+type chunkedUpload struct {
+	mu sync.Mutex
+
+	ID          string `json:"upload_id"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ChunkSize   int64  `json:"chunk_size"`
+	TotalChunks int    `json:"total_chunks"`
+	Received    []bool `json:"received"`
+	SHA256      string `json:"sha256,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SenderIP    string `json:"sender_ip"`
+	ClaimMode   string `json:"claim_mode"`
+	MaxClaims   int    `json:"max_claims,omitempty"`
+
+	SenderDevice string   `json:"sender_device,omitempty"`
+	Targets      []string `json:"targets,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	lastProgress time.Time
+	completing   bool // 正在校验合并，期间不再接受分片和取消
+	done         bool // 已完成或已取消
+}
+
+func (u *chunkedUpload) chunkLength(index int) int64 {
+	if index == u.TotalChunks-1 {
+		return u.Size - int64(index)*u.ChunkSize
+	}
+	return u.ChunkSize
+}
+
+// 请求方是否为任务的创建者，规则与 FileInfo.SentBy 相同：有设备ID时按设备比较，否则按 IP
+func (u *chunkedUpload) ownedBy(deviceID, ip string) bool {
+	if u.SenderDevice != "" {
+		return u.SenderDevice == deviceID
+	}
+	return u.SenderIP == ip
+}
+
+func (u *chunkedUpload) receivedBytesLocked() int64 {
+	var n int64
+	for i, ok := range u.Received {
+		if ok {
+			n += u.chunkLength(i)
+		}
+	}
+	return n
+}
+
+func (u *chunkedUpload) missingLocked() []int {
+	missing := []int{}
+	for i, ok := range u.Received {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+func (u *chunkedUpload) statusLocked() gin.H {
+	return gin.H{
+		"upload_id":      u.ID,
+		"filename":       u.Filename,
+		"size":           u.Size,
+		"chunk_size":     u.ChunkSize,
+		"total_chunks":   u.TotalChunks,
+		"received_bytes": u.receivedBytesLocked(),
+		"missing_chunks": u.missingLocked(),
+	}
+}
+
+type uploadManager struct {
+	mu      sync.Mutex
+	dir     string
+	files   *FileStore // 合并完成的文件登记到这里
+	uploads map[string]*chunkedUpload
+}
+
+func newUploadManager(dir string, files *FileStore) (*uploadManager, error) {
+	dir = filepath.Join(dir, ".chunked")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &uploadManager{dir: dir, files: files, uploads: make(map[string]*chunkedUpload)}
+
+	// 恢复未完成的上传任务
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var u chunkedUpload
+		if err := json.Unmarshal(data, &u); err != nil || u.ID == "" {
+			log.Printf("⚠️ 上传任务状态损坏，已跳过: %s", path)
+			continue
+		}
+		if _, err := os.Stat(m.partPath(u.ID)); err != nil {
+			os.Remove(path)
+			continue
+		}
+		m.uploads[u.ID] = &u
+	}
+	if len(m.uploads) > 0 {
+		log.Printf("✅ 已恢复 %d 个未完成的分片上传任务", len(m.uploads))
+	}
+	return m, nil
+}
+
+func (m *uploadManager) partPath(id string) string {
+	return filepath.Join(m.dir, id+".part")
+}
+
+func (m *uploadManager) statePath(id string) string {
+	return filepath.Join(m.dir, id+".json")
+}
+
+func (m *uploadManager) saveStateLocked(u *chunkedUpload) error {
+	return writeJSONAtomic(m.statePath(u.ID), u)
+}
+
+// meta 中由调用方填写 Filename、Type、Size、SHA256（可选）、SenderIP 和领取模式
+func (m *uploadManager) Create(meta FileInfo, chunkSize int64) (*chunkedUpload, error) {
+	now := time.Now()
+	size := meta.Size
+	u := &chunkedUpload{
+		ID:          newULID(now),
+		Filename:    meta.Filename,
+		Size:        size,
+		ChunkSize:   chunkSize,
+		TotalChunks: int((size + chunkSize - 1) / chunkSize),
+		SHA256:      strings.ToLower(meta.SHA256),
+		ContentType: meta.Type,
+		SenderIP:    meta.SenderIP,
+		ClaimMode:   meta.ClaimMode,
+		MaxClaims:   meta.MaxClaims,
+
+		SenderDevice: meta.SenderDevice,
+		Targets:      meta.Targets,
+
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if u.TotalChunks == 0 {
+		u.TotalChunks = 1 // 空文件也按一个分片处理
+	}
+	u.Received = make([]bool, u.TotalChunks)
+
+	// 预先创建好完整大小的分片文件，之后按偏移写入
+	f, err := os.Create(m.partPath(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(m.partPath(u.ID))
+		return nil, err
+	}
+	f.Close()
+
+	if err := m.saveStateLocked(u); err != nil {
+		os.Remove(m.partPath(u.ID))
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.uploads[u.ID] = u
+	m.mu.Unlock()
+	return u, nil
+}
+
+func (m *uploadManager) Get(id string) (*chunkedUpload, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.uploads[id]
+	return u, ok
+}
+
+// 写入一个分片。checksum 形如 "sha256=<hex>" 或 "crc32=<hex>"
+func (m *uploadManager) WriteChunk(u *chunkedUpload, index int, body io.Reader, checksum string) error {
+	// 分片大小和数量创建后不再变化，可以不加锁读取。
+	// 先从网络读完并校验分片再加锁，避免慢速上传期间阻塞该任务的状态查询
+	if index < 0 || index >= u.TotalChunks {
+		return errChunkOutOfRange
+	}
+	expected := u.chunkLength(index)
+	data, err := io.ReadAll(io.LimitReader(body, expected+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != expected {
+		return errChunkSize
+	}
+	if !verifyChunkChecksum(data, checksum) {
+		return errChunkChecksum
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.done {
+		return errUploadNotFound
+	}
+	if u.completing {
+		return errUploadCompleting
+	}
+
+	f, err := os.OpenFile(m.partPath(u.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, int64(index)*u.ChunkSize); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	u.Received[index] = true
+	u.UpdatedAt = time.Now()
+	return m.saveStateLocked(u)
+}
+
+func verifyChunkChecksum(data []byte, checksum string) bool {
+	algo, value, ok := strings.Cut(strings.TrimSpace(checksum), "=")
+	if !ok {
+		return false
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch strings.ToLower(algo) {
+	case "sha256":
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]) == value
+	case "crc32":
+		expected, err := strconv.ParseUint(value, 16, 32)
+		return err == nil && uint32(expected) == crc32.ChecksumIEEE(data)
+	}
+	return false
+}
+
+// 合并完成：校验整体哈希后登记为共享文件。
+// 文件可能有几个GB，计算哈希时不持有锁，只标记为合并中，期间状态查询不受影响
+func (m *uploadManager) Complete(u *chunkedUpload) (FileInfo, error) {
+	u.mu.Lock()
+	if u.done {
+		u.mu.Unlock()
+		return FileInfo{}, errUploadNotFound
+	}
+	if u.completing {
+		u.mu.Unlock()
+		return FileInfo{}, errUploadCompleting
+	}
+	if len(u.missingLocked()) > 0 {
+		u.mu.Unlock()
+		return FileInfo{}, errUploadIncomplete
+	}
+	u.completing = true
+	u.mu.Unlock()
+
+	info, err := m.commit(u)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.completing = false
+	if err != nil {
+		return FileInfo{}, err
+	}
+	u.done = true
+	m.remove(u.ID)
+	return info, nil
+}
+
+// 校验整体哈希并把分片文件登记为共享文件，调用方需先标记 completing
+func (m *uploadManager) commit(u *chunkedUpload) (FileInfo, error) {
+	f, err := os.Open(m.partPath(u.ID))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if u.SHA256 != "" && u.SHA256 != sum {
+		return FileInfo{}, errFileChecksum
+	}
+
+	return m.files.commit(m.partPath(u.ID), FileInfo{
+		Filename:  u.Filename,
+		Type:      u.ContentType,
+		Size:      u.Size,
+		SHA256:    sum,
+		SenderIP:  u.SenderIP,
+		ClaimMode: u.ClaimMode,
+		MaxClaims: u.MaxClaims,
+
+		SenderDevice: u.SenderDevice,
+		SenderName:   devices.Name(u.SenderDevice),
+		Targets:      u.Targets,
+	})
+}
+
+// 删除任务记录和分片文件
+func (m *uploadManager) remove(id string) {
+	m.mu.Lock()
+	delete(m.uploads, id)
+	m.mu.Unlock()
+	os.Remove(m.partPath(id))
+	os.Remove(m.statePath(id))
+}
+
+// 后台清理长时间没有进展的上传任务，done 关闭后退出
+func (m *uploadManager) StartJanitor(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			cutoff := time.Now().Add(-chunkedUploadTTL)
+			m.mu.Lock()
+			all := make([]*chunkedUpload, 0, len(m.uploads))
+			for _, u := range m.uploads {
+				all = append(all, u)
+			}
+			m.mu.Unlock()
+
+			for _, u := range all {
+				u.mu.Lock()
+				stale := !u.done && !u.completing && u.UpdatedAt.Before(cutoff)
+				if stale {
+					u.done = true
+					m.remove(u.ID)
+				}
+				u.mu.Unlock()
+				if stale {
+					log.Printf("🧹 已清理过期的分片上传: %s (%s)", u.Filename, u.ID)
+				}
+			}
+		}
+	}()
+}
+
+// 广播上传进度，uploading 状态按 uploadProgressInterval 限流
+func (room *Room) broadcastUploadProgress(u *chunkedUpload, status string) {
+	u.mu.Lock()
+	if status == "uploading" && time.Since(u.lastProgress) < uploadProgressInterval {
+		u.mu.Unlock()
+		return
+	}
+	u.lastProgress = time.Now()
+	received := u.receivedBytesLocked()
+	data := map[string]interface{}{
+		"upload_id":      u.ID,
+		"filename":       u.Filename,
+		"size":           u.Size,
+		"received_bytes": received,
+		"percent":        0.0,
+		"sender_ip":      u.SenderIP,
+		"sender_name":    devices.Name(u.SenderDevice),
+		"status":         status,
+	}
+	if u.Size > 0 {
+		data["percent"] = float64(received) * 100 / float64(u.Size)
+	}
+	u.mu.Unlock()
+
+	room.sendToDevices("file_upload_progress", data, u.SenderDevice, u.Targets)
+}
+
+// 创建分片上传任务
+func createChunkedUploadHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "上传文件") {
+		return
+	}
+	room := roomFrom(c)
+	var requestData struct {
+		Filename    string   `json:"filename"`
+		Size        int64    `json:"size"`
+		ChunkSize   int64    `json:"chunk_size"`
+		SHA256      string   `json:"sha256"`
+		ContentType string   `json:"content_type"`
+		Mode        string   `json:"mode"`
+		MaxClaims   int      `json:"max_claims"`
+		Targets     []string `json:"targets"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+
+	filename := filepath.Base(strings.TrimSpace(requestData.Filename))
+	if requestData.Filename == "" || filename == "." || filename == string(filepath.Separator) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "缺少文件名"})
+		return
+	}
+	if !allowedFile(filename) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "不支持的文件类型"})
+		return
+	}
+	if requestData.Size < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "文件大小无效"})
+		return
+	}
+	if requestData.Size > maxChunkedUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"success": false, "error": fmt.Sprintf("文件过大，最大支持%dMB", maxChunkedUploadSize/1024/1024)})
+		return
+	}
+
+	chunkSize := requestData.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	if chunkSize < minChunkSize {
+		chunkSize = minChunkSize
+	}
+	if chunkSize > maxChunkSize {
+		chunkSize = maxChunkSize
+	}
+	if (requestData.Size+chunkSize-1)/chunkSize > maxUploadChunks {
+		chunkSize = (requestData.Size + maxUploadChunks - 1) / maxUploadChunks
+	}
+	if chunkSize > maxChunkSize {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": fmt.Sprintf("文件过大，分片上传最多%d个分片，每个分片最大%dMB", maxUploadChunks, maxChunkSize/1024/1024)})
+		return
+	}
+
+	claimMode, maxClaims, err := parseClaimMode(requestData.Mode, requestData.MaxClaims)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	u, err := room.uploads.Create(FileInfo{
+		Filename:  filename,
+		Type:      requestData.ContentType,
+		Size:      requestData.Size,
+		SHA256:    requestData.SHA256,
+		SenderIP:  c.ClientIP(),
+		ClaimMode: claimMode,
+		MaxClaims: maxClaims,
+
+		SenderDevice: requestDeviceID(c),
+		Targets:      parseTargets(requestData.Targets),
+	}, chunkSize)
+	if err != nil {
+		log.Printf("❌ 创建分片上传失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "创建上传任务失败"})
+		return
+	}
+	log.Printf("✅ 分片上传已创建: %s (%d bytes, %d 个分片)", filename, u.Size, u.TotalChunks)
+	room.broadcastUploadProgress(u, "started")
+
+	u.mu.Lock()
+	status := u.statusLocked()
+	u.mu.Unlock()
+	status["success"] = true
+	c.Header("Location", room.Base()+"/uploads/"+u.ID)
+	c.JSON(http.StatusCreated, status)
+}
+
+// 按路径参数查找上传任务，只有创建者可以访问。
+// 不存在或不属于请求方时都返回 404，避免通过进度广播中的 upload_id 操作他人的上传
+func requestUpload(c *gin.Context, room *Room) (*chunkedUpload, bool) {
+	u, ok := room.uploads.Get(c.Param("id"))
+	if !ok || !u.ownedBy(requestDeviceID(c), c.ClientIP()) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "上传任务不存在"})
+		return nil, false
+	}
+	return u, true
+}
+
+// 查询分片上传状态
+func getChunkedUploadHandler(c *gin.Context) {
+	room := roomFrom(c)
+	u, ok := requestUpload(c, room)
+	if !ok {
+		return
+	}
+
+	u.mu.Lock()
+	status := u.statusLocked()
+	u.mu.Unlock()
+	status["success"] = true
+	c.JSON(http.StatusOK, status)
+}
+
+// 上传单个分片
+func uploadChunkHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "上传文件") {
+		return
+	}
+	room := roomFrom(c)
+	u, ok := requestUpload(c, room)
+	if !ok {
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "分片序号无效"})
+		return
+	}
+
+	checksum := c.GetHeader("X-Chunk-Checksum")
+	if checksum == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "缺少分片校验值"})
+		return
+	}
+
+	err = room.uploads.WriteChunk(u, index, c.Request.Body, checksum)
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": err.Error()})
+		return
+	case errors.Is(err, errUploadCompleting):
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": err.Error()})
+		return
+	case errors.Is(err, errChunkOutOfRange), errors.Is(err, errChunkSize):
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	case errors.Is(err, errChunkChecksum):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"success": false, "error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("❌ 写入分片失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "写入分片失败"})
+		return
+	}
+
+	room.broadcastUploadProgress(u, "uploading")
+
+	u.mu.Lock()
+	received := u.receivedBytesLocked()
+	u.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"success": true, "index": index, "received_bytes": received})
+}
+
+// 完成分片上传
+func completeChunkedUploadHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "上传文件") {
+		return
+	}
+	room := roomFrom(c)
+	u, ok := requestUpload(c, room)
+	if !ok {
+		return
+	}
+
+	fileInfo, err := room.uploads.Complete(u)
+	if errors.Is(err, errUploadNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if errors.Is(err, errUploadCompleting) {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if errors.Is(err, errUploadIncomplete) {
+		u.mu.Lock()
+		status := u.statusLocked()
+		u.mu.Unlock()
+		status["success"] = false
+		status["error"] = err.Error()
+		c.JSON(http.StatusConflict, status)
+		return
+	}
+	if errors.Is(err, errFileChecksum) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ 合并分片失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "合并文件失败"})
+		return
+	}
+
+	room.broadcastUploadProgress(u, "completed")
+
+	notification := fileInfo
+	notification.Action = "file_incoming"
+	deliveries := room.sendToDevices("file_incoming", notification, fileInfo.SenderDevice, fileInfo.Targets)
+	log.Printf("✅ 分片上传完成并已广播: %s (%d bytes) from %s", fileInfo.Filename, fileInfo.Size, fileInfo.SenderIP)
+
+	message := fmt.Sprintf("文件 \"%s\" 已发送给局域网所有设备！", fileInfo.Filename)
+	if len(fileInfo.Targets) > 0 {
+		message = fmt.Sprintf("文件 \"%s\" 已发送给 %d 个指定设备", fileInfo.Filename, len(fileInfo.Targets))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"message":    message,
+		"file_id":    fileInfo.FileID,
+		"filename":   fileInfo.Filename,
+		"size":       fileInfo.Size,
+		"url":        fileInfo.URL,
+		"deliveries": deliveries,
+	})
+}
+
+// 取消分片上传
+func abortChunkedUploadHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "取消上传") {
+		return
+	}
+	room := roomFrom(c)
+	u, ok := requestUpload(c, room)
+	if !ok {
+		return
+	}
+
+	u.mu.Lock()
+	if u.done {
+		u.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "上传任务不存在"})
+		return
+	}
+	if u.completing {
+		u.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": errUploadCompleting.Error()})
+		return
+	}
+	u.done = true
+	room.uploads.remove(u.ID)
+	u.mu.Unlock()
+
+	room.broadcastUploadProgress(u, "aborted")
+	log.Printf("✅ 分片上传已取消: %s (%s)", u.Filename, u.ID)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 文件领取：由服务器登记每个文件被哪些设备领取，先到先得。
+//   - exclusive：只能被一个设备领取
+//   - shared：不限制领取数量
+//   - first-N：只能被前 N 个设备领取（也可以写成 mode=first-n 并单独传 max_claims）
+// 同一设备重复领取视为成功，不重复计数。
+// 领取者按设备ID区分（经过反向代理或域名访问时所有设备的 IP 可能相同，且 IP 可以伪造），
+// 没有设备ID的请求和之前按 IP 登记的领取记录才按 IP 比较。
+
+const (
+	claimModeExclusive = "exclusive"
+	claimModeShared    = "shared"
+	claimModeFirstN    = "first-n"
+)
+
+var errFileClaimed = errors.New("文件已被领取")
+
+type FileClaim struct {
+	ClaimerDevice string `json:"claimer_device,omitempty"`
+	ClaimerIP     string `json:"claimer_ip"`
+	ClaimTime     string `json:"claim_time"`
+}
+
+// 领取记录是否属于请求方
+func (claim FileClaim) matches(deviceID, ip string) bool {
+	if claim.ClaimerDevice != "" {
+		return claim.ClaimerDevice == deviceID
+	}
+	return claim.ClaimerIP == ip
+}
+
+// 解析领取模式，返回规范化后的模式名和最大领取数（shared 为 0 表示不限）
+func parseClaimMode(mode string, maxClaims int) (string, int, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch {
+	case mode == "" || mode == claimModeExclusive:
+		return claimModeExclusive, 1, nil
+	case mode == claimModeShared:
+		return claimModeShared, 0, nil
+	case strings.HasPrefix(mode, "first-"):
+		if n, err := strconv.Atoi(strings.TrimPrefix(mode, "first-")); err == nil {
+			maxClaims = n
+		}
+		if maxClaims <= 0 {
+			return "", 0, fmt.Errorf("领取模式 %s 缺少有效的领取人数", mode)
+		}
+		return claimModeFirstN, maxClaims, nil
+	}
+	return "", 0, fmt.Errorf("不支持的领取模式: %s", mode)
+}
+
+// 剩余可领取数量，-1 表示不限
+func (f FileInfo) RemainingClaims() int {
+	if f.MaxClaims <= 0 {
+		return -1
+	}
+	return max(f.MaxClaims-len(f.Claims), 0)
+}
+
+func (f FileInfo) ClaimsExhausted() bool {
+	return f.MaxClaims > 0 && len(f.Claims) >= f.MaxClaims
+}
+
+func (f FileInfo) ClaimedBy(deviceID, ip string) bool {
+	for _, claim := range f.Claims {
+		if claim.matches(deviceID, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求方是否为文件的发送者，规则与领取记录相同
+func (f FileInfo) SentBy(deviceID, ip string) bool {
+	if f.SenderDevice != "" {
+		return f.SenderDevice == deviceID
+	}
+	return f.SenderIP == ip
+}
+
+// 领取被拒绝时仍返回文件当前状态，便于客户端展示
+func (s *FileStore) Claim(id, claimerDevice, claimerIP string) (FileInfo, FileClaim, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.files[id]
+	if !ok {
+		return FileInfo{}, FileClaim{}, errFileNotFound
+	}
+
+	for _, claim := range info.Claims {
+		if claim.matches(claimerDevice, claimerIP) {
+			return info, claim, nil
+		}
+	}
+	if info.ClaimsExhausted() {
+		return info, FileClaim{}, errFileClaimed
+	}
+
+	claim := FileClaim{
+		ClaimerDevice: claimerDevice,
+		ClaimerIP:     claimerIP,
+		ClaimTime:     time.Now().In(time.Local).Format("2006-01-02 15:04:05"),
+	}
+	previous := info.Claims
+	info.Claims = append(append([]FileClaim{}, previous...), claim)
+	s.files[id] = info
+	if err := s.saveIndexLocked(); err != nil {
+		info.Claims = previous
+		s.files[id] = info
+		return FileInfo{}, FileClaim{}, err
+	}
+	return info, claim, nil
+}
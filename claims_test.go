@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseClaimMode(t *testing.T) {
+	tests := []struct {
+		mode      string
+		maxClaims int
+		wantMode  string
+		wantMax   int
+		wantErr   bool
+	}{
+		{"", 0, claimModeExclusive, 1, false},
+		{"exclusive", 5, claimModeExclusive, 1, false},
+		{" Exclusive ", 0, claimModeExclusive, 1, false},
+		{"shared", 3, claimModeShared, 0, false},
+		{"first-3", 0, claimModeFirstN, 3, false},
+		{"FIRST-3", 7, claimModeFirstN, 3, false}, // 模式名中的人数优先
+		{"first-n", 2, claimModeFirstN, 2, false},
+		{"first-n", 0, "", 0, true},
+		{"first-0", 0, "", 0, true},
+		{"first--1", 0, "", 0, true},
+		{"broadcast", 0, "", 0, true},
+	}
+	for _, tt := range tests {
+		mode, maxN, err := parseClaimMode(tt.mode, tt.maxClaims)
+		if (err != nil) != tt.wantErr || mode != tt.wantMode || maxN != tt.wantMax {
+			t.Errorf("parseClaimMode(%q, %d) = %q, %d, %v，期望 %q, %d, 出错=%v",
+				tt.mode, tt.maxClaims, mode, maxN, err, tt.wantMode, tt.wantMax, tt.wantErr)
+		}
+	}
+}
+
+func TestFileStoreClaim(t *testing.T) {
+	type claimer struct {
+		device, ip string
+	}
+	var (
+		a      = claimer{"dev-a", "10.0.0.1"}
+		b      = claimer{"dev-b", "10.0.0.2"}
+		c      = claimer{"dev-c", "10.0.0.3"}
+		sameIP = claimer{"dev-d", "10.0.0.1"} // 与 a 同一 IP（例如经过反向代理）的另一台设备
+		noID   = claimer{"", "10.0.0.1"}      // 没有设备ID，按 IP 比较
+	)
+
+	tests := []struct {
+		name     string
+		mode     string
+		claimers []claimer
+		want     []bool // 每次领取是否成功
+		wantN    int    // 最终的领取记录数
+	}{
+		{
+			name:     "独占：第二个领取者被拒绝",
+			mode:     "exclusive",
+			claimers: []claimer{a, b, c},
+			want:     []bool{true, false, false},
+			wantN:    1,
+		},
+		{
+			name:     "独占：同一设备重复领取仍成功",
+			mode:     "exclusive",
+			claimers: []claimer{a, a, b},
+			want:     []bool{true, true, false},
+			wantN:    1,
+		},
+		{
+			name:     "独占：同一 IP 的另一台设备被拒绝",
+			mode:     "exclusive",
+			claimers: []claimer{a, sameIP},
+			want:     []bool{true, false},
+			wantN:    1,
+		},
+		{
+			name:     "共享：所有领取者都成功",
+			mode:     "shared",
+			claimers: []claimer{a, b, c, sameIP},
+			want:     []bool{true, true, true, true},
+			wantN:    4,
+		},
+		{
+			name:     "共享：重复领取不重复计数",
+			mode:     "shared",
+			claimers: []claimer{a, b, a, b},
+			want:     []bool{true, true, true, true},
+			wantN:    2,
+		},
+		{
+			name:     "前两名：第三个领取者被拒绝",
+			mode:     "first-2",
+			claimers: []claimer{a, b, c},
+			want:     []bool{true, true, false},
+			wantN:    2,
+		},
+		{
+			name:     "前两名：额满后已领取的设备仍可再次领取",
+			mode:     "first-2",
+			claimers: []claimer{a, b, a, c},
+			want:     []bool{true, true, true, false},
+			wantN:    2,
+		},
+		{
+			name:     "前两名：同一 IP 的不同设备分别计数",
+			mode:     "first-2",
+			claimers: []claimer{a, sameIP, b},
+			want:     []bool{true, true, false},
+			wantN:    2,
+		},
+		{
+			name:     "前两名：没有设备ID时按 IP 识别重复领取",
+			mode:     "first-2",
+			claimers: []claimer{noID, noID, b, c},
+			want:     []bool{true, true, true, false},
+			wantN:    2,
+		},
+	}
+
+	store, err := newFileStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode, maxClaims, err := parseClaimMode(tt.mode, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := store.Save(strings.NewReader("hello"), FileInfo{
+				Filename:  "a.txt",
+				ClaimMode: mode,
+				MaxClaims: maxClaims,
+			}, 1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var latest FileInfo
+			for i, cl := range tt.claimers {
+				got, _, err := store.Claim(info.FileID, cl.device, cl.ip)
+				if ok := err == nil; ok != tt.want[i] {
+					t.Fatalf("第 %d 次领取 (%s, %s) 成功=%v，期望 %v: %v", i+1, cl.device, cl.ip, ok, tt.want[i], err)
+				}
+				if err != nil && !errors.Is(err, errFileClaimed) {
+					t.Fatalf("第 %d 次领取返回 %v，期望 errFileClaimed", i+1, err)
+				}
+				latest = got
+			}
+			if len(latest.Claims) != tt.wantN {
+				t.Errorf("领取记录数 = %d，期望 %d", len(latest.Claims), tt.wantN)
+			}
+		})
+	}
+
+	if _, _, err := store.Claim("missing", a.device, a.ip); !errors.Is(err, errFileNotFound) {
+		t.Errorf("领取不存在的文件返回 %v，期望 errFileNotFound", err)
+	}
+}
+
+// 之前按 IP 登记的领取记录（没有设备ID）仍按 IP 匹配
+func TestFileClaimMatches(t *testing.T) {
+	tests := []struct {
+		claim      FileClaim
+		device, ip string
+		want       bool
+	}{
+		{FileClaim{ClaimerDevice: "dev-a", ClaimerIP: "10.0.0.1"}, "dev-a", "10.0.0.9", true},
+		{FileClaim{ClaimerDevice: "dev-a", ClaimerIP: "10.0.0.1"}, "dev-b", "10.0.0.1", false},
+		{FileClaim{ClaimerDevice: "dev-a", ClaimerIP: "10.0.0.1"}, "", "10.0.0.1", false},
+		{FileClaim{ClaimerIP: "10.0.0.1"}, "dev-b", "10.0.0.1", true},
+		{FileClaim{ClaimerIP: "10.0.0.1"}, "", "10.0.0.2", false},
+	}
+	for _, tt := range tests {
+		if got := tt.claim.matches(tt.device, tt.ip); got != tt.want {
+			t.Errorf("%+v.matches(%q, %q) = %v，期望 %v", tt.claim, tt.device, tt.ip, got, tt.want)
+		}
+	}
+}
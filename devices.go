@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 设备登记：每个设备由客户端生成并保存的设备令牌（device_token）识别，
+// 设备ID由令牌的 SHA-256 派生，令牌本身不落盘、不对外公开，其他设备只能看到设备ID。
+// 设备的昵称、UA、IP、首次/最近在线时间保存在 DevicesFile 中，重启后保留。
+// 新设备和改名立即保存；连接和断开只更新内存，由 StartFlusher 定期写入，避免手机频繁重连时反复写卡。
+//
+// 同一设备可以有多个连接（多个标签页），第一个连接建立和最后一个连接断开时
+// 广播 presence 事件。定向发送时按设备ID投递，只有目标设备（以及发送者自己）
+// 能收到事件、在列表中看到对应的消息和文件。
+//
+// WebSocket 连接和 HTTP 请求都通过 X-Device-Token 请求头或 device_token Cookie 识别设备，
+// 浏览器页面会把令牌写入 Cookie，WebSocket 握手、普通的 fetch 和下载链接都会自动带上。
+// 令牌不放在 URL 里，以免被访问日志记录。
+
+const (
+	DevicesFile = "devices.json"
+
+	deviceCookieName = "device_token"
+
+	maxNicknameLength = 32
+
+	// 最近在线时间等变化的保存间隔
+	deviceFlushInterval = 5 * time.Minute
+)
+
+// 投递状态
+const (
+	deliveryDelivered = "delivered" // 已放入目标设备的发送队列
+	deliveryOffline   = "offline"   // 目标设备当前不在线
+)
+
+var errDeviceNotFound = errors.New("设备不存在")
+
+type DeviceInfo struct {
+	DeviceID  string `json:"device_id"`
+	Nickname  string `json:"nickname"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+
+	// 运行时状态，启动时重置
+	Online      bool `json:"online"`
+	Connections int  `json:"connections"`
+}
+
+// 单个目标设备的投递结果
+type DeliveryStatus struct {
+	DeviceID string `json:"device_id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+}
+
+type deviceRegistry struct {
+	mu      sync.Mutex
+	path    string
+	devices map[string]*DeviceInfo
+	dirty   bool // 有尚未保存的变化
+}
+
+func newDeviceRegistry(path string) (*deviceRegistry, error) {
+	r := &deviceRegistry{path: path, devices: make(map[string]*DeviceInfo)}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var list []DeviceInfo
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, d := range list {
+			d.Online = false
+			d.Connections = 0
+			r.devices[d.DeviceID] = &d
+		}
+	}
+	return r, nil
+}
+
+// 由设备令牌派生设备ID
+func deviceIDFromToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// 生成新的设备令牌，供没有令牌的客户端使用
+func newDeviceToken() string {
+	var raw [16]byte
+	rand.Read(raw[:])
+	return hex.EncodeToString(raw[:])
+}
+
+func cleanNickname(name string) string {
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > maxNicknameLength {
+		name = string(runes[:maxNicknameLength])
+	}
+	return name
+}
+
+// 登记一个连接，返回设备信息和是否刚刚上线（之前没有其他连接）。
+// 昵称为空时沿用之前的昵称
+func (r *deviceRegistry) Attach(token, nickname, ip, userAgent string) (DeviceInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := time.Now().In(time.Local).Format("2006-01-02 15:04:05")
+	id := deviceIDFromToken(token)
+	d, ok := r.devices[id]
+	changed := !ok
+	if !ok {
+		d = &DeviceInfo{DeviceID: id, FirstSeen: seen}
+		r.devices[id] = d
+	}
+	if nickname = cleanNickname(nickname); nickname != "" && nickname != d.Nickname {
+		d.Nickname = nickname
+		changed = true
+	}
+	if d.Nickname == "" {
+		d.Nickname = "设备-" + id[:4]
+	}
+	d.IP = ip
+	d.UserAgent = userAgent
+	d.LastSeen = seen
+	d.Connections++
+	cameOnline := !d.Online
+	d.Online = true
+
+	if changed {
+		r.saveLocked()
+	} else {
+		r.dirty = true
+	}
+	return *d, cameOnline
+}
+
+// 连接断开，返回设备信息和是否已经下线（所有连接都断开了）
+func (r *deviceRegistry) Detach(id string) (DeviceInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.devices[id]
+	if !ok {
+		return DeviceInfo{}, false
+	}
+	d.Connections--
+	d.LastSeen = time.Now().In(time.Local).Format("2006-01-02 15:04:05")
+	wentOffline := false
+	if d.Connections <= 0 {
+		d.Connections = 0
+		d.Online = false
+		wentOffline = true
+	}
+
+	r.dirty = true
+	return *d, wentOffline
+}
+
+// 修改设备昵称
+func (r *deviceRegistry) Rename(id, nickname string) (DeviceInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.devices[id]
+	if !ok {
+		return DeviceInfo{}, errDeviceNotFound
+	}
+	d.Nickname = nickname
+	if err := r.saveLocked(); err != nil {
+		return DeviceInfo{}, err
+	}
+	return *d, nil
+}
+
+// 设备列表：在线的在前，其余按最近在线时间倒序
+func (r *deviceRegistry) List() []DeviceInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]DeviceInfo, 0, len(r.devices))
+	for _, d := range r.devices {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Online != list[j].Online {
+			return list[i].Online
+		}
+		if list[i].LastSeen != list[j].LastSeen {
+			return list[i].LastSeen > list[j].LastSeen
+		}
+		return list[i].DeviceID < list[j].DeviceID
+	})
+	return list
+}
+
+func (r *deviceRegistry) Get(id string) (DeviceInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d, ok := r.devices[id]; ok {
+		return *d, true
+	}
+	return DeviceInfo{}, false
+}
+
+// 设备昵称，未登记的设备返回空字符串
+func (r *deviceRegistry) Name(id string) string {
+	d, _ := r.Get(id)
+	return d.Nickname
+}
+
+// 定期保存最近在线时间等变化
+func (r *deviceRegistry) StartFlusher(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			r.mu.Lock()
+			if r.dirty {
+				r.saveLocked()
+			}
+			r.mu.Unlock()
+		}
+	}()
+}
+
+func (r *deviceRegistry) saveLocked() error {
+	list := make([]DeviceInfo, 0, len(r.devices))
+	for _, d := range r.devices {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceID < list[j].DeviceID })
+	if err := writeJSONAtomic(r.path, list); err != nil {
+		log.Printf("❌ 保存设备列表失败: %v", err)
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// 请求方的设备令牌：优先 X-Device-Token 请求头，其次 device_token Cookie
+func requestDeviceToken(c *gin.Context) string {
+	if token := strings.TrimSpace(c.GetHeader("X-Device-Token")); token != "" {
+		return token
+	}
+	if token, err := c.Cookie(deviceCookieName); err == nil {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// 请求方的设备ID，没有带设备令牌时返回空字符串
+func requestDeviceID(c *gin.Context) string {
+	if token := requestDeviceToken(c); token != "" {
+		return deviceIDFromToken(token)
+	}
+	return ""
+}
+
+// 整理目标设备列表：支持逗号分隔，去掉空值和重复值
+func parseTargets(values []string) []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, id := range strings.Split(value, ",") {
+			id = strings.TrimSpace(id)
+			if id != "" && !seen[id] {
+				seen[id] = true
+				targets = append(targets, id)
+			}
+		}
+	}
+	return targets
+}
+
+// 没有指定目标的内容所有设备可见；定向内容只有目标设备和发送者可见
+func visibleTo(targets []string, sender, deviceID string) bool {
+	if len(targets) == 0 {
+		return true
+	}
+	if deviceID == "" {
+		return false
+	}
+	if deviceID == sender {
+		return true
+	}
+	for _, id := range targets {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// 广播设备上线、下线或改名
+func broadcastPresence(device DeviceInfo, action string) {
+	online := 0
+	for _, d := range devices.List() {
+		if d.Online {
+			online++
+		}
+	}
+	rooms.Broadcast("presence", map[string]interface{}{
+		"device": device,
+		"action": action,
+		"online": online,
+	})
+}
+
+// 获取设备列表，?online=1 时只返回在线设备
+func listDevicesHandler(c *gin.Context) {
+	list := devices.List()
+	if c.Query("online") == "1" {
+		online := list[:0]
+		for _, d := range list {
+			if d.Online {
+				online = append(online, d)
+			}
+		}
+		list = online
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"devices":   list,
+		"count":     len(list),
+		"device_id": requestDeviceID(c),
+	})
+}
+
+// 修改设备昵称
+func renameDeviceHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "修改设备名称") {
+		return
+	}
+	var requestData struct {
+		Nickname string `json:"nickname"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+	nickname := cleanNickname(requestData.Nickname)
+	if nickname == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "昵称不能为空"})
+		return
+	}
+
+	// 修改本机昵称需要 sender，修改其他设备需要 editor
+	id := c.Param("id")
+	self := requestDeviceID(c)
+	if id == "me" {
+		id = self
+	}
+	if id != self && !requireRole(c, RoleEditor, "修改其他设备的名称") {
+		return
+	}
+	device, err := devices.Rename(id, nickname)
+	if errors.Is(err, errDeviceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "设备不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存设备信息失败"})
+		return
+	}
+
+	broadcastPresence(device, "renamed")
+	c.JSON(http.StatusOK, gin.H{"success": true, "device": device})
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 共享文件存储：文件内容保存在上传目录下（以文件ID命名），
+// 元数据保存在同目录的 files.json 中。广播时只发送元数据和下载地址。
+
+const fileIndexName = "files.json"
+
+var (
+	errFileNotFound = errors.New("文件不存在")
+	errFileTooLarge = errors.New("文件过大")
+)
+
+type FileStore struct {
+	mu      sync.RWMutex
+	dir     string
+	baseURL string // 下载地址前缀（房间路径）
+	files   map[string]FileInfo
+}
+
+func newFileStore(dir, baseURL string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{dir: dir, baseURL: baseURL, files: make(map[string]FileInfo)}
+
+	data, err := os.ReadFile(filepath.Join(dir, fileIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var files []FileInfo
+		if err := json.Unmarshal(data, &files); err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			// 内容已丢失的记录直接丢弃
+			if _, err := os.Stat(s.blobPath(f.FileID)); err != nil {
+				log.Printf("⚠️ 文件 %s (%s) 内容缺失，已移除记录", f.FileID, f.Filename)
+				continue
+			}
+			s.files[f.FileID] = f
+		}
+	}
+
+	s.cleanupTempFiles()
+	return s, nil
+}
+
+func (s *FileStore) blobPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// 清理上次异常退出遗留的临时文件
+func (s *FileStore) cleanupTempFiles() {
+	matches, _ := filepath.Glob(filepath.Join(s.dir, ".upload-*"))
+	for _, m := range matches {
+		os.Remove(m)
+	}
+}
+
+// 把 r 中的内容保存为新文件，超过 maxSize 时返回 errFileTooLarge。
+// meta 中由调用方填写 Filename、Type（客户端声明的类型）、SenderIP 和领取模式
+func (s *FileStore) Save(r io.Reader, meta FileInfo, maxSize int64) (FileInfo, error) {
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // 重命名成功后此调用无效果
+
+	// 边写边计算哈希，多读一个字节用于判断是否超限
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, maxSize+1))
+	if err != nil {
+		tmp.Close()
+		return FileInfo{}, err
+	}
+	if size > maxSize {
+		tmp.Close()
+		return FileInfo{}, errFileTooLarge
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return FileInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return FileInfo{}, err
+	}
+
+	meta.Size = size
+	meta.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return s.commit(tmpName, meta)
+}
+
+// 把已写好的临时文件登记为共享文件，meta 需已填好 Size 和 SHA256
+func (s *FileStore) commit(tmpName string, meta FileInfo) (FileInfo, error) {
+	now := time.Now()
+	id := newULID(now)
+	info := meta
+	info.FileID = id
+	info.SizeMB = float64(meta.Size) / 1024 / 1024
+	info.Type = detectContentType(meta.Filename, meta.Type)
+	info.URL = s.baseURL + "/files/" + id
+	info.SendTime = now.In(time.Local).Format("2006-01-02 15:04:05")
+	if info.ClaimMode == "" {
+		info.ClaimMode = claimModeExclusive
+	}
+	info.Claims = []FileClaim{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(tmpName, s.blobPath(id)); err != nil {
+		return FileInfo{}, err
+	}
+	s.files[id] = info
+	if err := s.saveIndexLocked(); err != nil {
+		delete(s.files, id)
+		os.Remove(s.blobPath(id))
+		return FileInfo{}, err
+	}
+	return info, nil
+}
+
+func (s *FileStore) Get(id string) (FileInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.files[id]
+	return info, ok
+}
+
+// 打开文件内容用于下载
+func (s *FileStore) Open(id string) (*os.File, FileInfo, error) {
+	info, ok := s.Get(id)
+	if !ok {
+		return nil, FileInfo{}, errFileNotFound
+	}
+	f, err := os.Open(s.blobPath(id))
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return f, info, nil
+}
+
+// 按上传时间倒序列出所有文件
+func (s *FileStore) List() []FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := make([]FileInfo, 0, len(s.files))
+	for _, f := range s.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].FileID > files[j].FileID })
+	return files
+}
+
+func (s *FileStore) Delete(id string) (FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.files[id]
+	if !ok {
+		return FileInfo{}, errFileNotFound
+	}
+	delete(s.files, id)
+	if err := s.saveIndexLocked(); err != nil {
+		s.files[id] = info
+		return FileInfo{}, err
+	}
+	if err := os.Remove(s.blobPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️ 删除文件内容失败: %v", err)
+	}
+	return info, nil
+}
+
+func (s *FileStore) saveIndexLocked() error {
+	files := make([]FileInfo, 0, len(s.files))
+	for _, f := range s.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].FileID < files[j].FileID })
+	return writeJSONAtomic(filepath.Join(s.dir, fileIndexName), files)
+}
+
+// 优先使用扩展名推断类型，其次使用客户端声明的类型
+func detectContentType(filename, declared string) string {
+	if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); byExt != "" {
+		return byExt
+	}
+	if declared != "" {
+		return declared
+	}
+	return "application/octet-stream"
+}
+
+// 生成 Content-Disposition 头：filename 为 ASCII 兜底名，
+// filename* 按 RFC 5987 以 UTF-8 百分号编码原文件名，保证中文文件名正确显示
+func contentDisposition(disposition, filename string) string {
+	var fallback strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(), encodeRFC5987(filename))
+}
+
+// RFC 5987 attr-char 之外的字节全部百分号编码
+func encodeRFC5987(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || strings.IndexByte(attrChars, ch) >= 0 {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// 获取共享文件列表
+func listFilesHandler(c *gin.Context) {
+	room := roomFrom(c)
+	deviceID := requestDeviceID(c)
+	files := room.files.List()
+	visible := files[:0]
+	for _, f := range files {
+		if visibleTo(f.Targets, f.SenderDevice, deviceID) {
+			visible = append(visible, f)
+		}
+	}
+	files = visible
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"files":   files,
+		"count":   len(files),
+	})
+}
+
+// 下载共享文件，?inline=1 时在浏览器内预览
+func downloadFileHandler(c *gin.Context) {
+	room := roomFrom(c)
+	if info, ok := room.files.Get(c.Param("id")); !ok || !visibleTo(info.Targets, info.SenderDevice, requestDeviceID(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "文件不存在"})
+		return
+	}
+	f, info, err := room.files.Open(c.Param("id"))
+	if errors.Is(err, errFileNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "文件不存在"})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ 打开文件失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "读取文件失败"})
+		return
+	}
+	defer f.Close()
+
+	// 独占/限量文件领完后只允许领取者和发送者下载
+	requesterIP := c.ClientIP()
+	requesterDevice := requestDeviceID(c)
+	if info.ClaimsExhausted() && !info.ClaimedBy(requesterDevice, requesterIP) && !info.SentBy(requesterDevice, requesterIP) {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": "文件已被他人接收"})
+		return
+	}
+
+	disposition := "attachment"
+	if c.Query("inline") == "1" {
+		disposition = "inline"
+	}
+
+	modTime := time.Time{}
+	if stat, err := f.Stat(); err == nil {
+		modTime = stat.ModTime()
+	}
+
+	// 文件内容不会变化，ETag 直接使用内容哈希；
+	// Range / If-Range / If-None-Match 由 http.ServeContent 处理
+	c.Header("Content-Type", info.Type)
+	c.Header("Content-Disposition", contentDisposition(disposition, info.Filename))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "no-cache")
+	if info.SHA256 != "" {
+		c.Header("ETag", `"`+info.SHA256+`"`)
+	}
+	http.ServeContent(c.Writer, c.Request, info.Filename, modTime, f)
+
+	// 只有完整下载才通知其他设备，分段请求（续传、音视频拖动）和 304 不通知
+	if c.Request.Method != http.MethodGet || c.Writer.Status() != http.StatusOK {
+		return
+	}
+
+	downloaderIP := requesterIP
+	room.sendToDevices("file_downloaded", map[string]interface{}{
+		"file_id":       info.FileID,
+		"filename":      info.Filename,
+		"downloader_ip": downloaderIP,
+		"download_time": time.Now().In(time.Local).Format("2006-01-02 15:04:05"),
+		"action":        "file_downloaded",
+	}, info.SenderDevice, info.Targets)
+	log.Printf("✅ 文件已下载: %s by %s", info.Filename, downloaderIP)
+}
+
+// 删除共享文件
+func deleteFileHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "删除文件") {
+		return
+	}
+	room := roomFrom(c)
+	if info, ok := room.files.Get(c.Param("id")); !ok || !visibleTo(info.Targets, info.SenderDevice, requestDeviceID(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "文件不存在"})
+		return
+	}
+	info, err := room.files.Delete(c.Param("id"))
+	if errors.Is(err, errFileNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "文件不存在"})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ 删除文件失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "删除文件失败"})
+		return
+	}
+
+	room.sendToDevices("file_deleted", map[string]interface{}{
+		"file_id":  info.FileID,
+		"filename": info.Filename,
+		"action":   "file_deleted",
+	}, info.SenderDevice, info.Targets)
+	log.Printf("✅ 文件已删除: %s (%s)", info.Filename, info.FileID)
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "file_id": info.FileID})
+}
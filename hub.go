@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket 连接中心
+//
+// 所有连接的注册、注销和广播都在 Hub.Run 这一个 goroutine 里处理，不需要加锁。
+// 每个客户端有独立的发送队列和写协程，保证同一个连接不会被并发写入；
+// 某个客户端的队列满了（手机休眠、网络太慢）就直接断开它，不会拖慢其他设备。
+//
+// 每个广播事件都带有单调递增的序号 seq，最近的事件保存在环形缓冲区中。
+// 客户端重连后发送 resume（带上 epoch 和最后收到的 seq），只补发缺失的事件；
+// 缓冲区已经覆盖不到、或服务器重启过（epoch 不同）时，退回到全量同步。
+//
+// 定向事件只放入目标设备的发送队列，补发时同样按设备过滤。
+//
+// 每个房间有自己的 Hub，广播只发给本房间的连接；房间删除时 Stop 断开全部连接。
+
+const (
+	// 单个客户端发送队列长度
+	clientSendQueueSize = 256
+
+	// 单次写入的超时时间
+	writeWait = 10 * time.Second
+
+	// 等待客户端 pong 的最长时间，超时即视为断线
+	pongWait = 60 * time.Second
+
+	// 发送 ping 的间隔，必须小于 pongWait
+	pingPeriod = pongWait * 9 / 10
+
+	// 客户端单条消息的最大长度
+	maxClientMessageSize = 64 * 1024
+
+	// 清理僵死连接的检查间隔
+	reapInterval = 30 * time.Second
+
+	// 断开后保留会话记录的时间，期间重连可识别为同一设备
+	sessionTTL = 24 * time.Hour
+
+	// 事件缓冲区保留的最大事件数和最大字节数
+	eventHistorySize  = 1024
+	eventHistoryBytes = 8 * 1024 * 1024
+)
+
+type Client struct {
+	hub          *Hub
+	conn         *websocket.Conn
+	send         chan []byte
+	sessionID    string
+	deviceID     string
+	credentialID string       // 扫码配对设备连接时使用的凭据ID，凭据吊销时断开
+	lastSeen     atomic.Int64 // 最近一次收到数据（含 pong）的 Unix 纳秒时间
+}
+
+func (c *Client) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// 发给单个客户端的消息
+type directMessage struct {
+	client  *Client
+	message []byte
+}
+
+// 待广播的事件，序号在 Hub.Run 中分配。
+// audience 为空时发给所有客户端，否则只发给其中的设备，投递结果写入 result
+type hubEvent struct {
+	msgType  string
+	data     interface{}
+	audience map[string]bool
+	targets  []string
+	result   chan []DeliveryStatus
+}
+
+// 客户端请求补发 lastSeq 之后的事件。snapshot 为全量同步数据，
+// 由 Run 在补发之前放入发送队列；能否增量同步的结果写入 result
+type resumeRequest struct {
+	client   *Client
+	epoch    string
+	lastSeq  uint64
+	snapshot []byte
+	result   chan bool
+}
+
+type Hub struct {
+	clients    map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan hubEvent
+	direct     chan directMessage
+	resume     chan resumeRequest
+	disconnect chan string
+	done       chan struct{}
+
+	// 全量同步时读取的消息存储
+	messages *MessageStore
+
+	// 本次进程启动的标识，服务器重启后序号从头开始，客户端据此判断能否增量同步
+	epoch   string
+	seq     atomic.Uint64
+	history eventRing
+}
+
+func newHub(messages *MessageStore) *Hub {
+	return &Hub{
+		clients:    make(map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan hubEvent, clientSendQueueSize),
+		direct:     make(chan directMessage, clientSendQueueSize),
+		resume:     make(chan resumeRequest),
+		disconnect: make(chan string),
+		done:       make(chan struct{}),
+		messages:   messages,
+		epoch:      newULID(time.Now()),
+		history:    eventRing{maxEvents: eventHistorySize, maxBytes: eventHistoryBytes},
+	}
+}
+
+func (h *Hub) Run() {
+	reapTicker := time.NewTicker(reapInterval)
+	defer reapTicker.Stop()
+
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+			log.Printf("✅ 客户端已注册，当前在线 %d 个", len(h.clients))
+
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				close(client.send)
+				log.Printf("❌ 客户端已注销，当前在线 %d 个", len(h.clients))
+			}
+
+		case event := <-h.broadcast:
+			h.deliver(event)
+
+		case req := <-h.resume:
+			// 已断开的客户端不需要补发
+			_, ok := h.clients[req.client]
+			req.result <- !ok || h.handleResume(req)
+
+		case dm := <-h.direct:
+			if _, ok := h.clients[dm.client]; ok {
+				h.enqueue(dm.client, dm.message)
+			}
+
+		case credentialID := <-h.disconnect:
+			for client := range h.clients {
+				if client.credentialID == credentialID {
+					delete(h.clients, client)
+					close(client.send)
+					log.Printf("🚫 凭据已吊销，断开连接 (会话 %s)", client.sessionID)
+				}
+			}
+
+		case <-reapTicker.C:
+			h.reap()
+
+		case <-h.done:
+			// 先发完已排队的事件（例如 room_deleted），再断开所有客户端
+			for len(h.broadcast) > 0 {
+				h.deliver(<-h.broadcast)
+			}
+			for client := range h.clients {
+				close(client.send)
+			}
+			log.Printf("🛑 连接中心已停止，断开 %d 个客户端", len(h.clients))
+			return
+		}
+	}
+}
+
+// 分配序号、记入历史并放入各客户端的发送队列
+func (h *Hub) deliver(event hubEvent) {
+	seq := h.seq.Load() + 1
+	messageBytes, err := json.Marshal(WebSocketMessage{Type: event.msgType, Data: event.data, Seq: seq})
+	if err != nil {
+		// 仍然返回投递结果（全部未投递），否则 SendTo 的调用方会一直等待
+		log.Printf("❌ 序列化消息失败: %v", err)
+		if event.result != nil {
+			event.result <- deliveryResults(event.targets, nil)
+		}
+		return
+	}
+	h.seq.Store(seq)
+	h.history.push(seq, messageBytes, event.audience)
+	delivered := make(map[string]string)
+	for client := range h.clients {
+		if event.audience != nil && !event.audience[client.deviceID] {
+			continue
+		}
+		if h.enqueue(client, messageBytes) {
+			delivered[client.deviceID] = devices.Name(client.deviceID)
+		}
+	}
+	if event.result != nil {
+		event.result <- deliveryResults(event.targets, delivered)
+	}
+}
+
+// 停止 Hub 并断开所有客户端，之后的广播和注册都直接丢弃
+func (h *Hub) Stop() {
+	close(h.done)
+}
+
+func (h *Hub) Register(client *Client) {
+	select {
+	case h.register <- client:
+	case <-h.done:
+		close(client.send)
+	}
+}
+
+// 断开使用指定设备凭据的所有连接
+func (h *Hub) DisconnectCredential(credentialID string) {
+	select {
+	case h.disconnect <- credentialID:
+	case <-h.done:
+	}
+}
+
+func (h *Hub) Unregister(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+// 放入客户端发送队列，队列已满说明客户端跟不上，直接断开
+func (h *Hub) enqueue(client *Client, message []byte) bool {
+	select {
+	case client.send <- message:
+		return true
+	default:
+		delete(h.clients, client)
+		close(client.send)
+		log.Printf("⚠️ 客户端发送队列已满，已断开")
+		return false
+	}
+}
+
+// 按目标顺序整理投递结果，delivered 为已投递的设备ID -> 设备名称
+func deliveryResults(targets []string, delivered map[string]string) []DeliveryStatus {
+	results := make([]DeliveryStatus, 0, len(targets))
+	for _, id := range targets {
+		status := DeliveryStatus{DeviceID: id, Status: deliveryOffline}
+		if name, ok := delivered[id]; ok {
+			status.Name = name
+			status.Status = deliveryDelivered
+		}
+		results = append(results, status)
+	}
+	return results
+}
+
+// 清理超过 pongWait 没有任何响应的连接。正常情况下读超时会先触发，
+// 这里兜底处理读协程卡住等异常情况
+func (h *Hub) reap() {
+	deadline := time.Now().Add(-pongWait).UnixNano()
+	for client := range h.clients {
+		if client.lastSeen.Load() < deadline {
+			delete(h.clients, client)
+			close(client.send)
+			client.conn.Close()
+			log.Printf("🧹 已清理僵死连接 (会话 %s)", client.sessionID)
+		}
+	}
+}
+
+// Hub 是否已停止。broadcast 有缓冲，停止后发送仍可能被 select 选中，所以先检查 done
+func (h *Hub) stopped() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 广播事件给所有客户端
+func (h *Hub) Broadcast(msgType string, data interface{}) {
+	if h.stopped() {
+		return
+	}
+	select {
+	case h.broadcast <- hubEvent{msgType: msgType, data: data}:
+	case <-h.done:
+	}
+}
+
+// 只发给目标设备和发送者自己的其他连接，等待 Hub 投递完成后返回每个目标的投递结果
+func (h *Hub) SendTo(msgType string, data interface{}, sender string, targets []string) []DeliveryStatus {
+	audience := make(map[string]bool, len(targets)+1)
+	for _, id := range targets {
+		audience[id] = true
+	}
+	if sender != "" {
+		audience[sender] = true
+	}
+	if h.stopped() {
+		return deliveryResults(targets, nil)
+	}
+	result := make(chan []DeliveryStatus, 1)
+	select {
+	case h.broadcast <- hubEvent{msgType: msgType, data: data, audience: audience, targets: targets, result: result}:
+	case <-h.done:
+		return deliveryResults(targets, nil)
+	}
+	// 事件放入队列后 Hub 可能已停止（房间被删除），不再等待投递结果
+	select {
+	case deliveries := <-result:
+		return deliveries
+	case <-h.done:
+		return deliveryResults(targets, nil)
+	}
+}
+
+// 当前最新的事件序号
+func (h *Hub) Seq() uint64 {
+	return h.seq.Load()
+}
+
+// 请求补发事件。补发在 Run 中进行，保证与后续广播的顺序一致；
+// 无法增量同步时在调用方的协程里生成全量快照，避免读取全部消息时阻塞其他客户端的广播
+func (h *Hub) Resume(client *Client, epoch string, lastSeq uint64) {
+	if h.resumeFrom(resumeRequest{client: client, epoch: epoch, lastSeq: lastSeq}) {
+		return
+	}
+	for {
+		// 先取序号再读消息：快照之后分配序号的事件都会接着快照补发，
+		// 其中已包含在快照里的新消息客户端会按消息ID去重
+		seq := h.seq.Load()
+		snapshot, err := json.Marshal(WebSocketMessage{Type: "sync_data", Data: fullSyncData(h.messages, seq, h.epoch, client.deviceID)})
+		if err != nil {
+			log.Printf("❌ 序列化消息失败: %v", err)
+			return
+		}
+		// 生成快照期间事件过多、缓冲区已覆盖不到快照的序号时重新生成
+		if h.resumeFrom(resumeRequest{client: client, epoch: h.epoch, lastSeq: seq, snapshot: snapshot}) {
+			log.Printf("⚠️ 无法增量同步，已发送全量数据 (会话 %s, seq %d)", client.sessionID, lastSeq)
+			return
+		}
+	}
+}
+
+// 交给 Run 处理补发请求并等待结果，只有需要全量同步时返回 false
+func (h *Hub) resumeFrom(req resumeRequest) bool {
+	if h.stopped() {
+		return true
+	}
+	req.result = make(chan bool, 1)
+	select {
+	case h.resume <- req:
+	case <-h.done:
+		return true
+	}
+	select {
+	case ok := <-req.result:
+		return ok
+	case <-h.done:
+		return true
+	}
+}
+
+// 补发 lastSeq 之后的事件，带有快照时先发送快照
+func (h *Hub) handleResume(req resumeRequest) bool {
+	if req.epoch != h.epoch {
+		return false
+	}
+	current := h.seq.Load()
+	missed, ok := h.history.since(req.lastSeq, current, req.client.deviceID)
+	if !ok {
+		return false
+	}
+	if req.snapshot != nil {
+		h.enqueue(req.client, req.snapshot)
+	}
+	for _, message := range missed {
+		h.enqueue(req.client, message)
+	}
+	if req.snapshot == nil {
+		log.Printf("✅ 增量同步: 会话 %s 补发 %d 个事件 (seq %d -> %d)", req.client.sessionID, len(missed), req.lastSeq, current)
+	}
+	return true
+}
+
+// 最近事件的环形缓冲区，只在 Hub.Run 中访问
+type eventRing struct {
+	seqs      []uint64
+	payloads  [][]byte
+	audiences []map[string]bool
+	bytes     int
+	maxEvents int
+	maxBytes  int
+}
+
+func (r *eventRing) push(seq uint64, payload []byte, audience map[string]bool) {
+	r.seqs = append(r.seqs, seq)
+	r.payloads = append(r.payloads, payload)
+	r.audiences = append(r.audiences, audience)
+	r.bytes += len(payload)
+	for len(r.seqs) > 1 && (len(r.seqs) > r.maxEvents || r.bytes > r.maxBytes) {
+		r.bytes -= len(r.payloads[0])
+		r.payloads[0] = nil
+		r.audiences[0] = nil
+		r.seqs = r.seqs[1:]
+		r.payloads = r.payloads[1:]
+		r.audiences = r.audiences[1:]
+	}
+}
+
+// 返回 lastSeq 之后 deviceID 可以收到的所有事件；缺失的事件已被淘汰时返回 false
+func (r *eventRing) since(lastSeq, current uint64, deviceID string) ([][]byte, bool) {
+	if lastSeq > current {
+		return nil, false
+	}
+	if lastSeq == current {
+		return nil, true
+	}
+	if len(r.seqs) == 0 || r.seqs[0] > lastSeq+1 {
+		return nil, false
+	}
+	// 按序号查找而不是按下标推算，序号不连续时也不会漏发
+	start := sort.Search(len(r.seqs), func(i int) bool { return r.seqs[i] > lastSeq })
+	missed := make([][]byte, 0, len(r.payloads)-start)
+	for i := start; i < len(r.payloads); i++ {
+		if r.audiences[i] == nil || r.audiences[i][deviceID] {
+			missed = append(missed, r.payloads[i])
+		}
+	}
+	return missed, true
+}
+
+// 只发给这一个客户端（经由 Hub 放入其发送队列）
+func (c *Client) Send(msgType string, data interface{}) {
+	messageBytes, err := json.Marshal(WebSocketMessage{Type: msgType, Data: data})
+	if err != nil {
+		log.Printf("❌ 序列化消息失败: %v", err)
+		return
+	}
+	select {
+	case c.hub.direct <- directMessage{client: c, message: messageBytes}:
+	case <-c.hub.done:
+	}
+}
+
+// 写协程：该连接唯一的写入者，同时负责定时发送 ping
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// 队列被 Hub 关闭，通知客户端后断开
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("⚠️ WebSocket写入失败: %v", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("⚠️ WebSocket心跳发送失败: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// 设置读限制和心跳超时，收到 pong 时延长读超时
+func (c *Client) prepareRead() {
+	c.touch()
+	c.conn.SetReadLimit(maxClientMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.touch()
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+// 会话记录：session ID -> 最近一次断开的时间（在线时为零值）
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]time.Time
+}
+
+var sessions = &sessionRegistry{sessions: make(map[string]time.Time)}
+
+// 判断客户端提交的会话ID是否可用，可用则复用并返回 resumed=true，否则分配新ID
+func (r *sessionRegistry) Attach(requested string) (sessionID string, resumed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expireLocked()
+	if requested != "" {
+		if _, ok := r.sessions[requested]; ok {
+			r.sessions[requested] = time.Time{}
+			return requested, true
+		}
+	}
+
+	sessionID = newULID(time.Now())
+	r.sessions[sessionID] = time.Time{}
+	return sessionID, false
+}
+
+// 连接断开时记录时间，sessionTTL 内重连仍可复用
+func (r *sessionRegistry) Detach(sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[sessionID] = time.Now()
+}
+
+func (r *sessionRegistry) expireLocked() {
+	cutoff := time.Now().Add(-sessionTTL)
+	for id, detachedAt := range r.sessions {
+		if !detachedAt.IsZero() && detachedAt.Before(cutoff) {
+			delete(r.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestEventRingSince(t *testing.T) {
+	type event struct {
+		seq      uint64
+		audience map[string]bool
+	}
+	events := func(seqs ...uint64) []event {
+		var list []event
+		for _, seq := range seqs {
+			list = append(list, event{seq: seq})
+		}
+		return list
+	}
+
+	tests := []struct {
+		name      string
+		maxEvents int
+		events    []event
+		lastSeq   uint64
+		current   uint64
+		deviceID  string
+		want      []string // 补发的事件序号
+		wantOK    bool
+	}{
+		{
+			name:    "没有事件",
+			lastSeq: 0,
+			current: 0,
+			wantOK:  true,
+		},
+		{
+			name:    "已是最新",
+			events:  events(1, 2, 3),
+			lastSeq: 3,
+			current: 3,
+			wantOK:  true,
+		},
+		{
+			name:    "补发之后的事件",
+			events:  events(1, 2, 3, 4, 5),
+			lastSeq: 2,
+			current: 5,
+			want:    []string{"3", "4", "5"},
+			wantOK:  true,
+		},
+		{
+			name:    "客户端的序号比服务器新（服务器重启过）",
+			events:  events(1, 2),
+			lastSeq: 7,
+			current: 2,
+			wantOK:  false,
+		},
+		{
+			name:      "缺失的事件已被淘汰",
+			maxEvents: 3,
+			events:    events(1, 2, 3, 4, 5),
+			lastSeq:   1,
+			current:   5,
+			wantOK:    false,
+		},
+		{
+			name:      "淘汰后仍能覆盖",
+			maxEvents: 3,
+			events:    events(1, 2, 3, 4, 5),
+			lastSeq:   2,
+			current:   5,
+			want:      []string{"3", "4", "5"},
+			wantOK:    true,
+		},
+		{
+			name:    "序号不连续",
+			events:  events(1, 2, 5, 6),
+			lastSeq: 2,
+			current: 6,
+			want:    []string{"5", "6"},
+			wantOK:  true,
+		},
+		{
+			name:    "上次收到的序号落在间隔中",
+			events:  events(1, 2, 5, 6),
+			lastSeq: 3,
+			current: 6,
+			want:    []string{"5", "6"},
+			wantOK:  true,
+		},
+		{
+			name:      "间隔之后的事件被淘汰",
+			maxEvents: 2,
+			events:    events(1, 2, 5, 6),
+			lastSeq:   2,
+			current:   6,
+			wantOK:    false,
+		},
+		{
+			name: "定向事件只补发给目标设备",
+			events: []event{
+				{seq: 1},
+				{seq: 2, audience: map[string]bool{"dev-a": true}},
+				{seq: 3, audience: map[string]bool{"dev-b": true}},
+				{seq: 4},
+			},
+			lastSeq:  0,
+			current:  4,
+			deviceID: "dev-b",
+			want:     []string{"1", "3", "4"},
+			wantOK:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := eventRing{maxEvents: tt.maxEvents, maxBytes: eventHistoryBytes}
+			if r.maxEvents == 0 {
+				r.maxEvents = eventHistorySize
+			}
+			for _, e := range tt.events {
+				r.push(e.seq, []byte(strconv.FormatUint(e.seq, 10)), e.audience)
+			}
+			missed, ok := r.since(tt.lastSeq, tt.current, tt.deviceID)
+			if ok != tt.wantOK {
+				t.Fatalf("since ok = %v，期望 %v", ok, tt.wantOK)
+			}
+			var got []string
+			for _, payload := range missed {
+				got = append(got, string(payload))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("since = %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 超过字节数上限时从最旧的事件开始淘汰，但至少保留最新的一个
+func TestEventRingMaxBytes(t *testing.T) {
+	r := eventRing{maxEvents: eventHistorySize, maxBytes: 10}
+	r.push(1, []byte("aaaa"), nil)
+	r.push(2, []byte("bbbb"), nil)
+	r.push(3, []byte("cccc"), nil)
+	if !reflect.DeepEqual(r.seqs, []uint64{2, 3}) || r.bytes != 8 {
+		t.Errorf("seqs = %v, bytes = %d，期望 [2 3], 8", r.seqs, r.bytes)
+	}
+
+	r.push(4, []byte("a very long payload"), nil)
+	if !reflect.DeepEqual(r.seqs, []uint64{4}) {
+		t.Errorf("seqs = %v，期望只保留 [4]", r.seqs)
+	}
+	if _, ok := r.since(2, 4, ""); ok {
+		t.Error("事件 3 已被淘汰，不应能增量同步")
+	}
+	if missed, ok := r.since(3, 4, ""); !ok || len(missed) != 1 {
+		t.Errorf("since(3) = %d 个事件, %v，期望 1 个事件", len(missed), ok)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// 消息日志：每次新增/删除/编辑只向日志文件追加一行 JSON，
+// 定期把内存中的完整消息列表压缩写入快照（DataFile）并清空日志。
+// 启动时先读快照再重放日志，日志重放是幂等的，压缩过程中断电也不会丢数据。
+
+const (
+	JournalFile = "messages.journal"
+
+	// 日志累积到这么多条时触发压缩
+	journalCompactThreshold = 500
+)
+
+// 日志操作类型
+const (
+	journalOpAdd    = "add"
+	journalOpDelete = "delete"
+	journalOpEdit   = "edit"
+)
+
+type journalEntry struct {
+	Op      string   `json:"op"`
+	ID      string   `json:"id"`
+	Message *Message `json:"message,omitempty"`
+}
+
+type messageJournal struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries int // 自上次压缩以来的日志条数
+}
+
+func openMessageJournal(path string) (*messageJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &messageJournal{file: file}, nil
+}
+
+// 追加一条日志并 fsync
+func (j *messageJournal) Append(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(line); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.entries++
+	return nil
+}
+
+func (j *messageJournal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.entries
+}
+
+// 快照写入成功后清空日志
+func (j *messageJournal) Reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.entries = 0
+	return nil
+}
+
+func (j *messageJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// 读取日志文件中的所有条目。最后一行如果不完整（写入时断电），直接丢弃
+func readJournal(path string) ([]journalEntry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 32*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("⚠️ 日志第%d行损坏，已跳过: %v", lineNum, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// 把日志重放到消息列表（最新在前）。重复的新增、找不到的删除都会被忽略
+func replayJournal(messages []Message, entries []journalEntry) []Message {
+	index := make(map[string]int, len(messages))
+	for i, msg := range messages {
+		index[msg.ID] = i
+	}
+
+	// 新增的消息先收集起来，最后统一放到最前面，避免反复移动切片
+	var added []Message
+	removedOld := make(map[int]bool)
+	removedAdded := make(map[int]bool)
+
+	for _, entry := range entries {
+		switch entry.Op {
+		case journalOpAdd:
+			if entry.Message == nil {
+				continue
+			}
+			if _, exists := index[entry.ID]; exists {
+				continue
+			}
+			added = append(added, *entry.Message)
+			index[entry.ID] = -len(added) // 负数表示在 added 中的位置
+		case journalOpEdit:
+			if entry.Message == nil {
+				continue
+			}
+			if i, exists := index[entry.ID]; exists {
+				if i >= 0 {
+					messages[i] = *entry.Message
+				} else {
+					added[-i-1] = *entry.Message
+				}
+			}
+		case journalOpDelete:
+			if i, exists := index[entry.ID]; exists {
+				if i >= 0 {
+					removedOld[i] = true
+				} else {
+					removedAdded[-i-1] = true
+				}
+				delete(index, entry.ID)
+			}
+		}
+	}
+
+	result := make([]Message, 0, len(added)+len(messages))
+	for i := len(added) - 1; i >= 0; i-- {
+		if !removedAdded[i] {
+			result = append(result, added[i])
+		}
+	}
+	for i, msg := range messages {
+		if !removedOld[i] {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
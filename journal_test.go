@@ -0,0 +1,222 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantIDs []string
+	}{
+		{
+			name:    "完整日志",
+			content: `{"op":"add","id":"a","message":{"id":"a","content":"1"}}` + "\n" + `{"op":"delete","id":"a"}` + "\n",
+			wantIDs: []string{"a", "a"},
+		},
+		{
+			name:    "最后一行写入时断电",
+			content: `{"op":"add","id":"a","message":{"id":"a","content":"1"}}` + "\n" + `{"op":"add","id":"b","mess`,
+			wantIDs: []string{"a"},
+		},
+		{
+			name:    "中间的损坏行和空行被跳过",
+			content: `{"op":"add","id":"a"}` + "\n\n" + `not json` + "\n" + `{"op":"delete","id":"b"}` + "\n",
+			wantIDs: []string{"a", "b"},
+		},
+		{
+			name:    "空文件",
+			content: "",
+			wantIDs: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), JournalFile)
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readJournal(path)
+			if err != nil {
+				t.Fatalf("readJournal: %v", err)
+			}
+			var ids []string
+			for _, entry := range entries {
+				ids = append(ids, entry.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("条目 = %v，期望 %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestReadJournalMissingFile(t *testing.T) {
+	entries, err := readJournal(filepath.Join(t.TempDir(), JournalFile))
+	if err != nil || entries != nil {
+		t.Errorf("readJournal = %v, %v，期望 nil, nil", entries, err)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	msg := func(id, content string) *Message {
+		return &Message{ID: id, Content: content}
+	}
+	add := func(id, content string) journalEntry {
+		return journalEntry{Op: journalOpAdd, ID: id, Message: msg(id, content)}
+	}
+	edit := func(id, content string) journalEntry {
+		return journalEntry{Op: journalOpEdit, ID: id, Message: msg(id, content)}
+	}
+	del := func(id string) journalEntry {
+		return journalEntry{Op: journalOpDelete, ID: id}
+	}
+
+	tests := []struct {
+		name     string
+		snapshot []Message
+		entries  []journalEntry
+		want     []string // 期望的 ID:内容，最新在前
+	}{
+		{
+			name:     "新增的消息按顺序放到最前面",
+			snapshot: []Message{*msg("b", "旧2"), *msg("a", "旧1")},
+			entries:  []journalEntry{add("c", "新1"), add("d", "新2")},
+			want:     []string{"d:新2", "c:新1", "b:旧2", "a:旧1"},
+		},
+		{
+			name:     "重复的新增被忽略",
+			snapshot: []Message{*msg("a", "旧")},
+			entries:  []journalEntry{add("a", "重复"), add("b", "新"), add("b", "又重复")},
+			want:     []string{"b:新", "a:旧"},
+		},
+		{
+			name:     "编辑快照中和日志中新增的消息",
+			snapshot: []Message{*msg("a", "旧")},
+			entries:  []journalEntry{add("b", "新"), edit("a", "改1"), edit("b", "改2")},
+			want:     []string{"b:改2", "a:改1"},
+		},
+		{
+			name:     "删除快照中和日志中新增的消息",
+			snapshot: []Message{*msg("b", "旧2"), *msg("a", "旧1")},
+			entries:  []journalEntry{add("c", "新"), del("a"), del("c")},
+			want:     []string{"b:旧2"},
+		},
+		{
+			name:     "找不到的编辑和删除被忽略",
+			snapshot: []Message{*msg("a", "旧")},
+			entries:  []journalEntry{edit("x", "无"), del("y"), {Op: journalOpAdd, ID: "z"}},
+			want:     []string{"a:旧"},
+		},
+		{
+			name:     "删除后重新新增",
+			snapshot: []Message{*msg("a", "旧")},
+			entries:  []journalEntry{del("a"), add("a", "新")},
+			want:     []string{"a:新"},
+		},
+		{
+			name:     "重放两次结果相同",
+			snapshot: []Message{*msg("a", "旧")},
+			entries:  []journalEntry{add("b", "新"), add("b", "新"), del("a"), del("a")},
+			want:     []string{"b:新"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, m := range replayJournal(tt.snapshot, tt.entries) {
+				got = append(got, m.ID+":"+m.Content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("replayJournal = %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 新增、编辑、删除后重新打开存储（重放日志），压缩后再打开，内容都应一致
+func TestMessageStoreReplayAndCompact(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "messages.txt")
+	journalPath := filepath.Join(dir, JournalFile)
+
+	// 移入回收站时会查询删除者的设备名称
+	registry, err := newDeviceRegistry(filepath.Join(dir, DevicesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices = registry
+
+	store, err := newMessageStore(dataPath, journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Message{{ID: "a", Content: "一"}, {ID: "b", Content: "二"}, {ID: "c", Content: "三"}} {
+		if err := store.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Update("b", func(m *Message) error {
+		m.Content = "二改"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Purge("a"); err == nil {
+		t.Fatal("未移入回收站的消息不应能彻底删除")
+	}
+	if _, err := store.MoveToTrash("a", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Purge("a"); err != nil {
+		t.Fatal(err)
+	}
+	if store.journal.Len() == 0 {
+		t.Fatal("修改应写入日志")
+	}
+	want := []string{"c:三", "b:二改"}
+	if got := contents(store.List()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("修改后 = %v，期望 %v", got, want)
+	}
+	store.Close()
+
+	// 不压缩直接重新打开：从日志重放，并在启动时压缩
+	store, err = newMessageStore(dataPath, journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(store.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("重放日志后 = %v，期望 %v", got, want)
+	}
+	if n := store.journal.Len(); n != 0 {
+		t.Errorf("启动时压缩后日志条数 = %d，期望 0", n)
+	}
+	if info, err := os.Stat(journalPath); err != nil || info.Size() != 0 {
+		t.Errorf("压缩后日志文件应为空: %v", err)
+	}
+	store.Close()
+
+	// 只从快照加载
+	store, err = newMessageStore(dataPath, journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := contents(store.List()); !reflect.DeepEqual(got, want) {
+		t.Errorf("从快照加载后 = %v，期望 %v", got, want)
+	}
+}
+
+func contents(messages []Message) []string {
+	var result []string
+	for _, m := range messages {
+		result = append(result, m.ID+":"+m.Content)
+	}
+	return result
+}
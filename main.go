@@ -1,21 +1,25 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -26,19 +30,72 @@ import (
 
 // 全局变量
 var (
-	clients    = make(map[*websocket.Conn]bool)
-	clientsMux = sync.RWMutex{}
-	upgrader   = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // 允许跨域
-		},
+	upgrader = websocket.Upgrader{
+		CheckOrigin: checkWebSocketOrigin,
 	}
+
+	// 房间（各自的消息、模板和文件存储）、设备登记和访问密码，在 main 中初始化
+	rooms   *roomRegistry
+	devices *deviceRegistry
+	auth    *authManager
+)
+
+// 存储位置和上限，分别对应 -upload-dir、-rooms-dir、-max-upload-size、
+// -max-chunked-upload-size 和 -trash-retention
+var (
+	uploadDir                  = "uploads"
+	roomsDir                   = "rooms"
+	maxUploadSize        int64 = 512 * 1024 * 1024
+	maxChunkedUploadSize int64 = 4 * 1024 * 1024 * 1024
+	trashRetention             = 7 * 24 * time.Hour
+
+	// 消息保留策略（-max-messages、-max-message-days），0 表示不限制
+	maxMessages    = 0
+	maxMessageDays = 0
 )
 
 // 数据结构
 type Message struct {
+	ID      string `json:"id"`
 	Time    string `json:"time"`
 	Content string `json:"content"`
+
+	// 发送者设备ID和昵称；Targets 为定向发送的目标设备ID，为空表示所有设备可见
+	SenderDevice string   `json:"sender_device,omitempty"`
+	SenderName   string   `json:"sender_name,omitempty"`
+	Targets      []string `json:"targets,omitempty"`
+
+	// 编辑记录：Revision 为当前版本号（未编辑过为0），Revisions 为之前的各个版本
+	Revision     int               `json:"revision,omitempty"`
+	EditedAt     string            `json:"edited_at,omitempty"`
+	EditorDevice string            `json:"editor_device,omitempty"`
+	EditorName   string            `json:"editor_name,omitempty"`
+	Revisions    []MessageRevision `json:"revisions,omitempty"`
+
+	// 回收站：删除时间和删除的设备，未删除时为空
+	DeletedAt     string `json:"deleted_at,omitempty"`
+	DeletedBy     string `json:"deleted_by,omitempty"`
+	DeletedByName string `json:"deleted_by_name,omitempty"`
+
+	// 阅后即焚：到期后由清理任务彻底删除
+	ExpiresAt string `json:"expires_at,omitempty"`
+
+	// 置顶的消息排在列表最前面，不受条数和天数保留策略影响；星标仅作标记
+	Pinned  bool `json:"pinned,omitempty"`
+	Starred bool `json:"starred,omitempty"`
+
+	// 标签：显式指定的标签加上内容中的 #标签。显式标签单独保存，编辑内容时只重新解析 #标签
+	Tags         []string `json:"tags,omitempty"`
+	ExplicitTags []string `json:"explicit_tags,omitempty"`
+}
+
+// 消息的一个历史版本：内容以及写下这个版本的时间和设备
+type MessageRevision struct {
+	Revision   int    `json:"revision"`
+	Content    string `json:"content"`
+	Time       string `json:"time"`
+	Device     string `json:"device,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
 }
 
 type Template struct {
@@ -62,17 +119,30 @@ type FileInfo struct {
 	Size     int64   `json:"size"`
 	SizeMB   float64 `json:"size_mb"`
 	Type     string  `json:"type"`
-	Data     string  `json:"data"`
+	URL      string  `json:"url"`
+	SHA256   string  `json:"sha256"`
 	SenderIP string  `json:"sender_ip"`
 	SendTime string  `json:"send_time"`
-	Action   string  `json:"action"`
+	Action   string  `json:"action,omitempty"`
+
+	// 领取模式：exclusive（独占）、shared（共享）、first-N（前N个）
+	ClaimMode string      `json:"claim_mode"`
+	MaxClaims int         `json:"max_claims,omitempty"`
+	Claims    []FileClaim `json:"claims"`
+
+	SenderDevice string   `json:"sender_device,omitempty"`
+	SenderName   string   `json:"sender_name,omitempty"`
+	Targets      []string `json:"targets,omitempty"`
 }
 
 type WebSocketMessage struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
+	Seq  uint64      `json:"seq,omitempty"`
 }
 
+var errMessageNotFound = errors.New("消息不存在")
+
 // 常量
 const (
 	DataFile      = "messages.txt"
@@ -101,6 +171,48 @@ var allowedExtensions = map[string]bool{
 }
 
 // 工具函数
+
+// Crockford Base32 字母表（ULID 使用）
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// 生成 ULID 格式的唯一ID：48位毫秒时间戳 + 80位随机数，共26个字符，按时间有序
+func newULID(t time.Time) string {
+	var raw [16]byte
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		raw[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := rand.Read(raw[6:]); err != nil {
+		log.Printf("⚠️ 生成随机数失败: %v", err)
+	}
+
+	// 128位按5位一组编码，首字符只占3位
+	out := make([]byte, 26)
+	var acc uint64
+	var bits uint
+	pos := 25
+	for i := 15; i >= 0; i-- {
+		acc |= uint64(raw[i]) << bits
+		bits += 8
+		for bits >= 5 && pos >= 0 {
+			out[pos] = ulidAlphabet[acc&0x1f]
+			acc >>= 5
+			bits -= 5
+			pos--
+		}
+	}
+	if pos >= 0 {
+		out[pos] = ulidAlphabet[acc&0x1f]
+	}
+	return string(out)
+}
+
+// 生成新的消息ID
+func newMessageID() string {
+	return newULID(time.Now())
+}
+
 func getLocalIP() string {
 	// 方法1：尝试通过连接外部服务器获取本地IP
 	conn, err := net.Dial("udp", "8.8.8.8:80")
@@ -193,7 +305,8 @@ func getLocalIP() string {
 	return "127.0.0.1"
 }
 
-func generateQRCode(r *http.Request) (string, string, bool) {
+// path 为房间路径，默认房间为空
+func generateQRCode(r *http.Request, path string) (string, string, bool) {
 	// 检测是否为域名访问
 	host := r.Host
 	isIPAccess := false
@@ -215,11 +328,11 @@ func generateQRCode(r *http.Request) (string, string, bool) {
 	if isIPAccess {
 		// IP访问使用http
 		protocol = "http"
-		url = fmt.Sprintf("%s://%s", protocol, host)
+		url = fmt.Sprintf("%s://%s%s", protocol, host, path)
 	} else {
 		// 域名访问使用https
 		protocol = "https"
-		url = fmt.Sprintf("%s://%s", protocol, host)
+		url = fmt.Sprintf("%s://%s%s", protocol, host, path)
 	}
 
 	log.Printf("🔄 生成二维码URL: %s (IP访问: %v)", url, isIPAccess)
@@ -243,14 +356,14 @@ func generateQRCode(r *http.Request) (string, string, bool) {
 	return dataURL, url, isIPAccess
 }
 
-func loadMessages() ([]Message, error) {
+func loadMessages(path string) ([]Message, error) {
 	var messages []Message
 
-	if _, err := os.Stat(DataFile); os.IsNotExist(err) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return messages, nil
 	}
 
-	data, err := os.ReadFile(DataFile)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -282,16 +395,39 @@ func loadMessages() ([]Message, error) {
 		}
 	}
 
+	// 旧数据没有ID，自动补齐并写回文件
+	if migrateMessageIDs(messages) {
+		if err := saveMessages(path, messages); err != nil {
+			log.Printf("⚠️ 保存迁移后的消息失败: %v", err)
+		} else {
+			log.Printf("✅ 已为旧消息补充ID并迁移为JSON格式")
+		}
+	}
+
 	return messages, nil
 }
 
-func saveMessages(messages []Message) error {
-	// 改用JSON格式存储，避免换行符问题
-	data, err := json.MarshalIndent(messages, "", "  ")
-	if err != nil {
-		return err
+// 为缺少ID的消息生成ID，返回是否有改动
+func migrateMessageIDs(messages []Message) bool {
+	changed := false
+	for i := range messages {
+		if messages[i].ID != "" {
+			continue
+		}
+		// 尽量使用消息原有时间生成ID，保持ID与时间顺序一致
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", messages[i].Time, time.Local)
+		if err != nil {
+			t = time.Now()
+		}
+		messages[i].ID = newULID(t)
+		changed = true
 	}
-	return os.WriteFile(DataFile, data, 0644)
+	return changed
+}
+
+func saveMessages(path string, messages []Message) error {
+	// 改用JSON格式存储，避免换行符问题
+	return writeJSONAtomic(path, messages)
 }
 
 func min(a, b int) int {
@@ -368,30 +504,24 @@ func createDefaultTemplates() TemplatesConfig {
 	}
 }
 
-func ensureTemplatesFile() error {
-	if _, err := os.Stat(TemplatesFile); os.IsNotExist(err) {
-		log.Printf("⚠️ 模板文件 %s 不存在，正在创建默认配置...", TemplatesFile)
+func ensureTemplatesFile(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Printf("⚠️ 模板文件 %s 不存在，正在创建默认配置...", path)
 		defaultConfig := createDefaultTemplates()
-		data, err := json.MarshalIndent(defaultConfig, "", "  ")
-		if err != nil {
-			return err
-		}
-
-		err = os.WriteFile(TemplatesFile, data, 0644)
-		if err != nil {
+		if err := writeJSONAtomic(path, defaultConfig); err != nil {
 			return err
 		}
-		log.Printf("✅ 默认模板配置文件已创建: %s", TemplatesFile)
+		log.Printf("✅ 默认模板配置文件已创建: %s", path)
 	}
 	return nil
 }
 
-func loadTemplates() (TemplatesConfig, error) {
+func loadTemplates(path string) (TemplatesConfig, error) {
 	var config TemplatesConfig
 
-	data, err := os.ReadFile(TemplatesFile)
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Printf("⚠️ 模板文件 %s 不存在", TemplatesFile)
+		log.Printf("⚠️ 模板文件 %s 不存在", path)
 		return TemplatesConfig{Categories: make(map[string]Category)}, nil
 	}
 
@@ -404,12 +534,8 @@ func loadTemplates() (TemplatesConfig, error) {
 	return config, nil
 }
 
-func saveTemplates(config TemplatesConfig) error {
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(TemplatesFile, data, 0644)
+func saveTemplates(path string, config TemplatesConfig) error {
+	return writeJSONAtomic(path, config)
 }
 
 func allowedFile(filename string) bool {
@@ -421,55 +547,78 @@ func allowedFile(filename string) bool {
 }
 
 // WebSocket 处理
-func broadcastMessage(msgType string, data interface{}) {
-	clientsMux.RLock()
-	defer clientsMux.RUnlock()
+// 全量同步数据，seq 为生成时的最新事件序号，客户端之后从该序号继续
+func fullSyncData(store *MessageStore, seq uint64, epoch, deviceID string) map[string]interface{} {
+	messages := visibleMessages(store.List(), deviceID)
 
-	message := WebSocketMessage{
-		Type: msgType,
-		Data: data,
-	}
-
-	messageBytes, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("❌ 序列化消息失败: %v", err)
-		return
+	// 创建消息副本并反转顺序，使最新的消息在数组前面
+	messagesCopy := make([]Message, len(messages))
+	for i, msg := range messages {
+		messagesCopy[len(messages)-1-i] = msg
 	}
 
-	for client := range clients {
-		err := client.WriteMessage(websocket.TextMessage, messageBytes)
-		if err != nil {
-			log.Printf("⚠️ WebSocket广播失败: %v", err)
-			client.Close()
-			delete(clients, client)
-		}
+	return map[string]interface{}{
+		"messages": withoutRevisions(messagesCopy),
+		"seq":      seq,
+		"epoch":    epoch,
 	}
 }
 
 func handleWebSocket(c *gin.Context) {
+	room := roomFrom(c)
+	hub := room.hub
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("❌ WebSocket连接升级失败: %v", err)
 		return
 	}
-	defer conn.Close()
 
-	clientsMux.Lock()
-	clients[conn] = true
-	clientsMux.Unlock()
+	// 重连时客户端会带上之前分配的会话ID
+	sessionID, resumed := sessions.Attach(c.Query("session"))
+
+	// 设备令牌由客户端生成并保存，没有令牌时分配一个新的，在 connected 消息中返回
+	deviceToken := requestDeviceToken(c)
+	if deviceToken == "" {
+		deviceToken = newDeviceToken()
+	}
+	device, cameOnline := devices.Attach(deviceToken, c.Query("device_name"), c.ClientIP(), c.Request.UserAgent())
 
-	log.Println("✅ 新WebSocket客户端连接")
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, clientSendQueueSize), sessionID: sessionID, deviceID: device.DeviceID, credentialID: c.GetString(credentialContextKey)}
+	client.prepareRead()
+	hub.Register(client)
+	go client.writePump()
+
+	if cameOnline {
+		broadcastPresence(device, "online")
+	}
+
+	if resumed {
+		log.Printf("✅ WebSocket客户端重连 (会话 %s, 房间 %s)", sessionID, room.Name)
+	} else {
+		log.Printf("✅ 新WebSocket客户端连接 (会话 %s, 房间 %s)", sessionID, room.Name)
+	}
 
 	// 发送连接确认
-	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"connected","data":{"message":"已连接到实时同步服务"}}`))
+	client.Send("connected", map[string]interface{}{
+		"message":      "已连接到实时同步服务",
+		"session_id":   sessionID,
+		"device_id":    device.DeviceID,
+		"device_name":  device.Nickname,
+		"device_token": deviceToken,
+		"resumed":      resumed,
+		"room":         room.Name,
+		"epoch":        hub.epoch,
+		"seq":          hub.Seq(),
+	})
 
-	// 处理客户端消息
+	// 处理客户端消息（读协程）
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("❌ WebSocket读取消息失败: %v", err)
 			break
 		}
+		client.touch()
 
 		var wsMsg WebSocketMessage
 		if err := json.Unmarshal(message, &wsMsg); err != nil {
@@ -480,47 +629,41 @@ func handleWebSocket(c *gin.Context) {
 		// 处理不同类型的消息
 		switch wsMsg.Type {
 		case "request_sync":
-			messages, err := loadMessages()
-			if err != nil {
-				log.Printf("❌ 同步数据错误: %v", err)
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"sync_error","data":{"error":"同步失败"}}`))
-			} else {
-				// 创建消息副本并反转顺序，使最新的消息在数组前面
-				messagesCopy := make([]Message, len(messages))
-				for i, msg := range messages {
-					messagesCopy[len(messages)-1-i] = msg
-				}
-
-				syncData := map[string]interface{}{
-					"messages": messagesCopy,
-				}
-				syncMsg := WebSocketMessage{
-					Type: "sync_data",
-					Data: syncData,
-				}
-				syncBytes, _ := json.Marshal(syncMsg)
-				conn.WriteMessage(websocket.TextMessage, syncBytes)
-				log.Println("✅ 数据同步请求已处理")
+			// 全量同步也走 resume 流程，由 Hub 保证与广播的先后顺序
+			hub.Resume(client, "", 0)
+			log.Println("✅ 数据同步请求已处理")
+
+		case "resume":
+			var resumeData struct {
+				Epoch   string `json:"epoch"`
+				LastSeq uint64 `json:"last_seq"`
+			}
+			raw, _ := json.Marshal(wsMsg.Data)
+			if err := json.Unmarshal(raw, &resumeData); err != nil {
+				log.Printf("❌ 解析resume请求失败: %v", err)
+				hub.Resume(client, "", 0)
+				continue
 			}
+			hub.Resume(client, resumeData.Epoch, resumeData.LastSeq)
 		}
 	}
 
 	// 清理连接
-	clientsMux.Lock()
-	delete(clients, conn)
-	clientsMux.Unlock()
-	log.Println("❌ WebSocket客户端断开连接")
+	hub.Unregister(client)
+	conn.Close()
+	sessions.Detach(sessionID)
+	if device, wentOffline := devices.Detach(device.DeviceID); wentOffline {
+		broadcastPresence(device, "offline")
+	}
+	log.Printf("❌ WebSocket客户端断开连接 (会话 %s)", sessionID)
 }
 
 // HTTP 路由处理函数
 func indexHandler(c *gin.Context) {
-	messages, err := loadMessages()
-	if err != nil {
-		log.Printf("❌ 加载消息失败: %v", err)
-		messages = []Message{}
-	}
+	room := roomFrom(c)
+	messages := pinnedFirst(visibleMessages(room.messages.List(), requestDeviceID(c)))
 
-	qrDataURL, serverURL, isIPAccess := generateQRCode(c.Request)
+	qrDataURL, serverURL, isIPAccess := generateQRCode(c.Request, room.Base())
 	log.Printf("🔍 传递给模板的二维码数据长度: %d", len(qrDataURL))
 	log.Printf("🔍 传递给模板的服务器地址: %s", serverURL)
 
@@ -538,57 +681,153 @@ func indexHandler(c *gin.Context) {
 		"server_url":   serverURL,
 		"network_type": networkType,
 		"is_ip_access": isIPAccess,
+		"room_name":    room.Name,
+		"room_title":   room.Title,
+		"room_base":    room.Base(),
+		"auth_enabled": auth.Enabled(),
+		"is_admin":     isAdmin(c),
+		"role":         requestRole(c),
+	})
+}
+
+// 创建新消息并广播。msg 中由调用方填写 Content、SenderDevice、Targets 和 ExpiresAt；
+// Targets 不为空时只发给目标设备，并返回每个目标的投递结果
+func (room *Room) createMessage(msg Message) (Message, []DeliveryStatus, error) {
+	timestamp := time.Now().In(time.Local).Format("2006-01-02 15:04:05")
+	newMessage := msg
+	newMessage.ID = newMessageID()
+	newMessage.Time = timestamp
+	newMessage.SenderName = devices.Name(msg.SenderDevice)
+	newMessage.ExplicitTags = normalizeTags(msg.Tags)
+	newMessage.Tags = messageTags(newMessage.ExplicitTags, msg.Content)
+	content, senderDevice, targets := msg.Content, msg.SenderDevice, msg.Targets
+
+	// 新消息插入到开头而不是末尾，使其显示在最上面
+	if err := room.messages.Add(newMessage); err != nil {
+		log.Printf("❌ 保存消息失败: %v", err)
+		return Message{}, nil, err
+	}
+
+	// 广播新消息
+	broadcastData := map[string]interface{}{
+		"id":      newMessage.ID,
+		"time":    timestamp,
+		"content": content,
+		"action":  "add",
+	}
+	if senderDevice != "" {
+		broadcastData["sender_device"] = senderDevice
+		broadcastData["sender_name"] = newMessage.SenderName
+	}
+	if len(targets) > 0 {
+		broadcastData["targets"] = targets
+	}
+	if newMessage.ExpiresAt != "" {
+		broadcastData["expires_at"] = newMessage.ExpiresAt
+	}
+	if len(newMessage.Tags) > 0 {
+		broadcastData["tags"] = newMessage.Tags
+		broadcastData["explicit_tags"] = newMessage.ExplicitTags
+	}
+	deliveries := room.sendToDevices("new_message", broadcastData, senderDevice, targets)
+	log.Printf("✅ 消息已广播: %s (%s, 目标 %d 个)", newMessage.ID, timestamp, len(targets))
+
+	return newMessage, deliveries, nil
+}
+
+// 置顶消息排在前面，其余保持原有顺序
+func pinnedFirst(messages []Message) []Message {
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Pinned && !messages[j].Pinned })
+	return messages
+}
+
+// 设置消息的置顶或星标状态并广播，flag 为 "pin" 或 "star"，value 为 nil 时切换当前状态
+func (room *Room) setMessageFlag(messageID, flag string, value *bool) (Message, error) {
+	updated, err := room.messages.Update(messageID, func(msg *Message) error {
+		target := &msg.Pinned
+		if flag == "star" {
+			target = &msg.Starred
+		}
+		if value != nil {
+			*target = *value
+		} else {
+			*target = !*target
+		}
+		return nil
 	})
+	if err != nil {
+		if !errors.Is(err, errMessageNotFound) {
+			log.Printf("❌ 保存消息失败: %v", err)
+		}
+		return Message{}, err
+	}
+
+	room.sendToDevices("message_flags", map[string]interface{}{
+		"id":      updated.ID,
+		"pinned":  updated.Pinned,
+		"starred": updated.Starred,
+		"action":  flag,
+	}, updated.SenderDevice, updated.Targets)
+	log.Printf("✅ 消息标记已广播: %s (pinned=%v, starred=%v)", updated.ID, updated.Pinned, updated.Starred)
+
+	return updated, nil
+}
+
+// 过滤出 deviceID 可见的消息
+func visibleMessages(messages []Message, deviceID string) []Message {
+	visible := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		if visibleTo(msg.Targets, msg.SenderDevice, deviceID) {
+			visible = append(visible, msg)
+		}
+	}
+	return visible
 }
 
 func addMessageHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "发送消息") {
+		return
+	}
+	room := roomFrom(c)
 	content := strings.TrimSpace(c.PostForm("content"))
 	if content == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "内容不能为空"})
 		return
 	}
 
-	messages, err := loadMessages()
+	expiresAt, err := parseMessageTTL(c.PostForm("ttl"))
 	if err != nil {
-		log.Printf("❌ 加载消息失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "加载消息失败"})
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
 		return
 	}
 
-	timestamp := time.Now().In(time.Local).Format("2006-01-02 15:04:05")
-	newMessage := Message{
-		Time:    timestamp,
-		Content: content,
-	}
-
-	// 将新消息插入到开头而不是末尾，使其显示在最上面
-	messages = append([]Message{newMessage}, messages...)
-	err = saveMessages(messages)
+	c.Request.ParseForm()
+	newMessage, deliveries, err := room.createMessage(Message{
+		Content:      content,
+		SenderDevice: requestDeviceID(c),
+		Targets:      parseTargets(c.Request.PostForm["targets"]),
+		ExpiresAt:    expiresAt,
+		Tags:         c.Request.PostForm["tags"],
+	})
 	if err != nil {
-		log.Printf("❌ 保存消息失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存消息失败"})
 		return
 	}
 
-	// 广播新消息
-	broadcastData := map[string]interface{}{
-		"time":    timestamp,
-		"content": content,
-		"action":  "add",
-	}
-	broadcastMessage("new_message", broadcastData)
-	log.Printf("✅ 消息已广播: %s", timestamp)
-
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"time":    timestamp,
-		"content": content,
+		"success":    true,
+		"id":         newMessage.ID,
+		"time":       newMessage.Time,
+		"content":    newMessage.Content,
+		"expires_at": newMessage.ExpiresAt,
+		"tags":       newMessage.Tags,
+		"deliveries": deliveries,
 	})
 }
 
 // 二维码API接口
 func qrCodeHandler(c *gin.Context) {
-	qrDataURL, serverURL, isIPAccess := generateQRCode(c.Request)
+	qrDataURL, serverURL, isIPAccess := generateQRCode(c.Request, roomFrom(c).Base())
 
 	// 判断网络类型
 	var networkType string
@@ -608,7 +847,7 @@ func qrCodeHandler(c *gin.Context) {
 
 // 测试二维码生成
 func testQRHandler(c *gin.Context) {
-	qrDataURL, serverURL, isIPAccess := generateQRCode(c.Request)
+	qrDataURL, serverURL, isIPAccess := generateQRCode(c.Request, "")
 	c.JSON(http.StatusOK, gin.H{
 		"qr_data_url":  qrDataURL,
 		"server_url":   serverURL,
@@ -721,120 +960,285 @@ func debugLanDetectionHandler(c *gin.Context) {
 	c.String(http.StatusOK, string(content))
 }
 
-func deleteMessageHandler(c *gin.Context) {
-	timestamp := c.PostForm("time")
-	if timestamp == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "未提供时间戳"})
-		return
+// 把消息移入回收站并广播删除。id为空时按时间戳删除第一条匹配的消息（兼容旧客户端）
+func (room *Room) removeMessage(messageID, timestamp, deviceID string) (Message, error) {
+	deleted, err := room.messages.MoveToTrash(messageID, timestamp, deviceID)
+	if err != nil {
+		if !errors.Is(err, errMessageNotFound) {
+			log.Printf("❌ 保存消息失败: %v", err)
+		}
+		return Message{}, err
 	}
 
-	messages, err := loadMessages()
+	// 广播删除消息
+	broadcastData := map[string]interface{}{
+		"id":     deleted.ID,
+		"time":   deleted.Time,
+		"action": "delete",
+	}
+	room.sendToDevices("message_deleted", broadcastData, deleted.SenderDevice, deleted.Targets)
+	log.Printf("✅ 删除消息已广播: %s (%s)", deleted.ID, deleted.Time)
+
+	return deleted, nil
+}
+
+// 从回收站恢复消息并重新广播
+func (room *Room) restoreMessage(messageID string) (Message, error) {
+	restored, err := room.messages.Restore(messageID)
 	if err != nil {
-		log.Printf("❌ 加载消息失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "加载消息失败"})
-		return
+		if !errors.Is(err, errMessageNotFound) {
+			log.Printf("❌ 保存消息失败: %v", err)
+		}
+		return Message{}, err
+	}
+
+	room.sendToDevices("new_message", map[string]interface{}{
+		"id":            restored.ID,
+		"time":          restored.Time,
+		"content":       restored.Content,
+		"sender_device": restored.SenderDevice,
+		"sender_name":   restored.SenderName,
+		"targets":       restored.Targets,
+		"revision":      restored.Revision,
+		"expires_at":    restored.ExpiresAt,
+		"pinned":        restored.Pinned,
+		"starred":       restored.Starred,
+		"tags":          restored.Tags,
+		"explicit_tags": restored.ExplicitTags,
+		"action":        "restore",
+	}, restored.SenderDevice, restored.Targets)
+	log.Printf("✅ 恢复消息已广播: %s (%s)", restored.ID, restored.Time)
+
+	return restored, nil
+}
+
+// 从回收站彻底删除消息并广播，其他设备打开的回收站随之移除
+func (room *Room) purgeMessage(messageID string) (Message, error) {
+	purged, err := room.messages.Purge(messageID)
+	if err != nil {
+		if !errors.Is(err, errMessageNotFound) {
+			log.Printf("❌ 保存消息失败: %v", err)
+		}
+		return Message{}, err
 	}
 
-	originalCount := len(messages)
-	var filteredMessages []Message
-	for _, msg := range messages {
-		if msg.Time != timestamp {
-			filteredMessages = append(filteredMessages, msg)
+	room.sendToDevices("message_purged", map[string]interface{}{
+		"id":     purged.ID,
+		"time":   purged.Time,
+		"action": "purge",
+	}, purged.SenderDevice, purged.Targets)
+	log.Printf("✅ 彻底删除消息已广播: %s (%s)", purged.ID, purged.Time)
+
+	return purged, nil
+}
+
+// 消息的当前版本：编辑过的取最后一次编辑的时间和设备，否则取发送时间和发送者
+func currentRevision(msg Message) MessageRevision {
+	current := MessageRevision{
+		Revision:   max(msg.Revision, 1),
+		Content:    msg.Content,
+		Time:       msg.Time,
+		Device:     msg.SenderDevice,
+		DeviceName: msg.SenderName,
+	}
+	if msg.EditedAt != "" {
+		current.Time = msg.EditedAt
+		current.Device = msg.EditorDevice
+		current.DeviceName = msg.EditorName
+	}
+	return current
+}
+
+// 修改消息内容并广播，修改前的版本保存在 Revisions 中。内容没有变化时不产生新版本
+func (room *Room) editMessage(messageID, content, editorDevice string) (Message, bool, error) {
+	changed := false
+	edited, err := room.messages.Update(messageID, func(msg *Message) error {
+		if msg.Content == content {
+			return nil
+		}
+		changed = true
+
+		previous := currentRevision(*msg)
+		msg.Revisions = append(msg.Revisions, previous)
+		if len(msg.Revisions) > maxMessageRevisions {
+			msg.Revisions = msg.Revisions[len(msg.Revisions)-maxMessageRevisions:]
+		}
+
+		msg.ExplicitTags = explicitTags(*msg)
+		msg.Tags = messageTags(msg.ExplicitTags, content)
+		msg.Content = content
+		msg.Revision = previous.Revision + 1
+		msg.EditedAt = time.Now().In(time.Local).Format("2006-01-02 15:04:05")
+		msg.EditorDevice = editorDevice
+		msg.EditorName = devices.Name(editorDevice)
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, errMessageNotFound) {
+			log.Printf("❌ 保存消息失败: %v", err)
 		}
+		return Message{}, false, err
+	}
+	if !changed {
+		return edited, false, nil
 	}
 
-	if len(filteredMessages) == originalCount {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "未找到要删除的消息"})
+	broadcastData := map[string]interface{}{
+		"id":            edited.ID,
+		"time":          edited.Time,
+		"content":       edited.Content,
+		"revision":      edited.Revision,
+		"edited_at":     edited.EditedAt,
+		"editor_device": edited.EditorDevice,
+		"editor_name":   edited.EditorName,
+		"tags":          edited.Tags,
+		"explicit_tags": edited.ExplicitTags,
+		"action":        "edit",
+	}
+	room.sendToDevices("message_edited", broadcastData, edited.SenderDevice, edited.Targets)
+	log.Printf("✅ 编辑消息已广播: %s (版本 %d)", edited.ID, edited.Revision)
+
+	return edited, true, nil
+}
+
+func deleteMessageHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "删除消息") {
+		return
+	}
+	room := roomFrom(c)
+	messageID := c.PostForm("id")
+	timestamp := c.PostForm("time")
+	if messageID == "" && timestamp == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "未提供消息ID"})
 		return
 	}
 
-	err = saveMessages(filteredMessages)
+	deleted, err := room.removeMessage(messageID, timestamp, requestDeviceID(c))
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "未找到要删除的消息"})
+		return
+	}
 	if err != nil {
-		log.Printf("❌ 保存消息失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存消息失败"})
 		return
 	}
 
-	// 广播删除消息
-	broadcastData := map[string]interface{}{
-		"time":   timestamp,
-		"action": "delete",
-	}
-	broadcastMessage("message_deleted", broadcastData)
-	log.Printf("✅ 删除消息已广播: %s", timestamp)
-
-	c.JSON(http.StatusOK, gin.H{"success": true})
+	c.JSON(http.StatusOK, gin.H{"success": true, "id": deleted.ID})
 }
 
-// 文件上传处理
+// 文件上传处理：流式写入磁盘，不在内存中缓存整个文件
 func uploadFileHandler(c *gin.Context) {
-	file, header, err := c.Request.FormFile("file")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "没有选择文件"})
+	if !requireRole(c, RoleSender, "上传文件") {
 		return
 	}
-	defer file.Close()
+	room := roomFrom(c)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize+1024*1024)
 
-	if header.Filename == "" {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "没有选择文件"})
 		return
 	}
 
-	if !allowedFile(header.Filename) {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "不支持的文件类型"})
-		return
+	// 领取模式可以放在查询参数中，也可以作为表单字段放在 file 字段之前
+	mode := c.Query("mode")
+	maxClaimsParam := c.Query("max_claims")
+	targetValues := c.QueryArray("targets")
+
+	var part *multipart.Part
+	for {
+		p, err := reader.NextPart()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "没有选择文件"})
+			return
+		}
+		if p.FormName() == "file" {
+			part = p
+			break
+		}
+		value, _ := io.ReadAll(io.LimitReader(p, 1024))
+		switch p.FormName() {
+		case "mode":
+			mode = string(value)
+		case "max_claims":
+			maxClaimsParam = string(value)
+		case "targets":
+			targetValues = append(targetValues, string(value))
+		}
 	}
+	defer part.Close()
 
-	// 读取文件内容
-	fileContent, err := io.ReadAll(file)
+	targets := parseTargets(targetValues)
+	maxClaims, _ := strconv.Atoi(strings.TrimSpace(maxClaimsParam))
+	claimMode, maxClaims, err := parseClaimMode(mode, maxClaims)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "读取文件失败"})
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
 		return
 	}
 
-	fileSize := int64(len(fileContent))
-	if fileSize > 16*1024*1024 { // 16MB限制
-		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "文件过大，最大支持16MB"})
+	filename := filepath.Base(part.FileName())
+	if part.FileName() == "" || filename == "." || filename == string(filepath.Separator) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "没有选择文件"})
 		return
 	}
 
-	// 转换为Base64
-	fileBase64 := base64.StdEncoding.EncodeToString(fileContent)
-
-	// 生成文件ID
-	fileID := fmt.Sprintf("%s_%s", time.Now().In(time.Local).Format("20060102_150405"), header.Filename)
+	if !allowedFile(filename) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "不支持的文件类型"})
+		return
+	}
 
 	// 获取发送者IP
 	senderIP := c.ClientIP()
-
-	// 创建文件信息
-	fileInfo := FileInfo{
-		FileID:   fileID,
-		Filename: header.Filename,
-		Size:     fileSize,
-		SizeMB:   float64(fileSize) / 1024 / 1024,
-		Type:     header.Header.Get("Content-Type"),
-		Data:     fileBase64,
-		SenderIP: senderIP,
-		SendTime: time.Now().In(time.Local).Format("2006-01-02 15:04:05"),
-		Action:   "file_incoming",
+	senderDevice := requestDeviceID(c)
+
+	fileInfo, err := room.files.Save(part, FileInfo{
+		Filename:     filename,
+		Type:         part.Header.Get("Content-Type"),
+		SenderIP:     senderIP,
+		SenderDevice: senderDevice,
+		SenderName:   devices.Name(senderDevice),
+		ClaimMode:    claimMode,
+		MaxClaims:    maxClaims,
+		Targets:      targets,
+	}, maxUploadSize)
+	if errors.Is(err, errFileTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"success": false, "error": fmt.Sprintf("文件过大，最大支持%dMB", maxUploadSize/1024/1024)})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ 保存文件失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存文件失败"})
+		return
 	}
 
-	// 实时广播文件给所有设备
-	broadcastMessage("file_incoming", fileInfo)
-	log.Printf("✅ 文件实时共享已广播: %s (%d bytes) from %s", header.Filename, fileSize, senderIP)
+	// 实时广播文件元数据和下载地址给所有设备（或指定的目标设备）
+	notification := fileInfo
+	notification.Action = "file_incoming"
+	deliveries := room.sendToDevices("file_incoming", notification, fileInfo.SenderDevice, fileInfo.Targets)
+	log.Printf("✅ 文件实时共享已广播: %s (%d bytes) from %s", filename, fileInfo.Size, senderIP)
 
+	message := fmt.Sprintf("文件 \"%s\" 已发送给局域网所有设备！", filename)
+	if len(targets) > 0 {
+		message = fmt.Sprintf("文件 \"%s\" 已发送给 %d 个指定设备", filename, len(targets))
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"success":  true,
-		"message":  fmt.Sprintf("文件 \"%s\" 已发送给局域网所有设备！", header.Filename),
-		"file_id":  fileID,
-		"filename": header.Filename,
-		"size":     fileSize,
+		"success":    true,
+		"message":    message,
+		"file_id":    fileInfo.FileID,
+		"filename":   filename,
+		"size":       fileInfo.Size,
+		"url":        fileInfo.URL,
+		"deliveries": deliveries,
 	})
 }
 
-// 文件接收确认处理
+// 文件接收确认处理：由服务器原子地登记领取，独占/限量文件被领完后返回 409
 func fileReceivedHandler(c *gin.Context) {
+	// 领取会占用独占/限量文件的名额，只读设备不能领取
+	if !requireRole(c, RoleSender, "领取文件") {
+		return
+	}
+	room := roomFrom(c)
 	var requestData struct {
 		FileID string `json:"file_id"`
 		Mode   string `json:"mode"`
@@ -850,56 +1254,90 @@ func fileReceivedHandler(c *gin.Context) {
 		return
 	}
 
+	if info, ok := room.files.Get(requestData.FileID); !ok || !visibleTo(info.Targets, info.SenderDevice, requestDeviceID(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "文件不存在"})
+		return
+	}
+
 	receiverIP := c.ClientIP()
-	if requestData.Mode == "" {
-		requestData.Mode = "exclusive"
+	info, claim, err := room.files.Claim(requestData.FileID, requestDeviceID(c), receiverIP)
+	if errors.Is(err, errFileNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "文件不存在"})
+		return
+	}
+	if errors.Is(err, errFileClaimed) {
+		log.Printf("⚠️ 文件已被领取: %s, %s 的领取请求被拒绝", requestData.FileID, receiverIP)
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   "文件已被他人接收",
+			"file":    info,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ 登记文件领取失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "登记领取失败"})
+		return
 	}
 
 	// 广播接收确认消息
 	notificationData := map[string]interface{}{
-		"file_id":      requestData.FileID,
-		"receiver_ip":  receiverIP,
-		"receive_time": time.Now().In(time.Local).Format("2006-01-02 15:04:05"),
-		"mode":         requestData.Mode,
-		"action":       "file_received",
-	}
-	broadcastMessage("file_received_notification", notificationData)
-	log.Printf("✅ 文件接收确认: %s by %s (mode: %s)", requestData.FileID, receiverIP, requestData.Mode)
+		"file_id":       info.FileID,
+		"receiver_ip":   claim.ClaimerIP,
+		"receiver_name": devices.Name(claim.ClaimerDevice),
+		"receive_time":  claim.ClaimTime,
+		"mode":          info.ClaimMode,
+		"max_claims":    info.MaxClaims,
+		"claims":        info.Claims,
+		"remaining":     info.RemainingClaims(),
+		"exhausted":     info.ClaimsExhausted(),
+		"action":        "file_received",
+	}
+	room.sendToDevices("file_received_notification", notificationData, info.SenderDevice, info.Targets)
+	log.Printf("✅ 文件接收确认: %s by %s (mode: %s, %d/%d)", info.FileID, receiverIP, info.ClaimMode, len(info.Claims), info.MaxClaims)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "接收确认已发送",
+		"file":    info,
 	})
 }
 
 // 获取模板数据
 func getTemplatesHandler(c *gin.Context) {
-	templatesData, err := loadTemplates()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "加载模板失败"})
-		return
-	}
-	c.JSON(http.StatusOK, templatesData)
+	room := roomFrom(c)
+	c.JSON(http.StatusOK, room.templates.Get())
 }
 
 // 更新模板数据
 func updateTemplatesHandler(c *gin.Context) {
+	if !requireRole(c, RoleEditor, "修改模板") {
+		return
+	}
+	room := roomFrom(c)
 	var templatesData TemplatesConfig
 	if err := c.ShouldBindJSON(&templatesData); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "数据格式错误"})
 		return
 	}
 
-	if err := saveTemplates(templatesData); err != nil {
+	if err := room.templates.Replace(templatesData); err != nil {
+		log.Printf("❌ 保存模板失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存模板数据失败"})
 		return
 	}
 
+	room.broadcastMessage("templates_updated", map[string]interface{}{"action": "replace"})
+
 	c.JSON(http.StatusOK, gin.H{"success": true, "message": "模板数据更新成功"})
 }
 
 // 向指定分类添加模板
 func addTemplateToCategoryHandler(c *gin.Context) {
+	if !requireRole(c, RoleEditor, "添加模板") {
+		return
+	}
+	room := roomFrom(c)
 	categoryKey := c.Param("categoryKey")
 	var templateData Template
 	if err := c.ShouldBindJSON(&templateData); err != nil {
@@ -907,18 +1345,6 @@ func addTemplateToCategoryHandler(c *gin.Context) {
 		return
 	}
 
-	templatesConfig, err := loadTemplates()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "加载模板失败"})
-		return
-	}
-
-	category, exists := templatesConfig.Categories[categoryKey]
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "分类不存在"})
-		return
-	}
-
 	newTitle := strings.TrimSpace(templateData.Title)
 	newContent := strings.TrimSpace(templateData.Content)
 
@@ -931,30 +1357,54 @@ func addTemplateToCategoryHandler(c *gin.Context) {
 		return
 	}
 
-	// 检查重复：只比较内容
-	for _, existingTemplate := range category.Templates {
-		if strings.TrimSpace(existingTemplate.Content) == newContent {
-			c.JSON(http.StatusOK, gin.H{
-				"success":      true,
-				"message":      "模板内容已存在，未重复添加",
-				"is_duplicate": true,
-			})
-			return
+	isDuplicate := false
+	err := room.templates.Update(func(templatesConfig *TemplatesConfig) error {
+		category, exists := templatesConfig.Categories[categoryKey]
+		if !exists {
+			return errCategoryNotFound
 		}
-	}
 
-	// 不重复，添加新模板
-	category.Templates = append(category.Templates, Template{
-		Title:   newTitle,
-		Content: newContent,
+		// 检查重复：只比较内容
+		for _, existingTemplate := range category.Templates {
+			if strings.TrimSpace(existingTemplate.Content) == newContent {
+				isDuplicate = true
+				return errDuplicateTemplate
+			}
+		}
+
+		// 不重复，添加新模板
+		category.Templates = append(category.Templates, Template{
+			Title:   newTitle,
+			Content: newContent,
+		})
+		templatesConfig.Categories[categoryKey] = category
+		return nil
 	})
-	templatesConfig.Categories[categoryKey] = category
 
-	if err := saveTemplates(templatesConfig); err != nil {
+	if errors.Is(err, errCategoryNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "分类不存在"})
+		return
+	}
+	if isDuplicate {
+		c.JSON(http.StatusOK, gin.H{
+			"success":      true,
+			"message":      "模板内容已存在，未重复添加",
+			"is_duplicate": true,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ 保存模板失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存失败"})
 		return
 	}
 
+	room.broadcastMessage("templates_updated", map[string]interface{}{
+		"action":   "add",
+		"category": categoryKey,
+		"template": Template{Title: newTitle, Content: newContent},
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"success":      true,
 		"message":      "模板添加成功",
@@ -964,14 +1414,14 @@ func addTemplateToCategoryHandler(c *gin.Context) {
 
 // 导出模板数据
 func exportTemplatesHandler(c *gin.Context) {
+	if !requireRole(c, RoleEditor, "导出模板") {
+		return
+	}
+	room := roomFrom(c)
 	formatType := c.Param("formatType")
 	categoriesParam := c.Query("categories")
 
-	templatesData, err := loadTemplates()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "加载模板失败"})
-		return
-	}
+	templatesData := room.templates.Get()
 
 	var filteredData TemplatesConfig
 	if categoriesParam != "" {
@@ -1006,6 +1456,10 @@ func exportTemplatesHandler(c *gin.Context) {
 
 // 导入模板数据
 func importTemplatesHandler(c *gin.Context) {
+	if !requireRole(c, RoleEditor, "导入模板") {
+		return
+	}
+	room := roomFrom(c)
 	// 获取上传的文件
 	file, header, err := c.Request.FormFile("file")
 	if err != nil {
@@ -1042,13 +1496,6 @@ func importTemplatesHandler(c *gin.Context) {
 		importMode = "replace" // 默认为替换模式
 	}
 
-	// 加载当前模板数据
-	currentTemplates, err := loadTemplates()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "加载当前模板失败"})
-		return
-	}
-
 	// 解析导入的数据
 	var importedData TemplatesConfig
 	var duplicateCount int
@@ -1081,48 +1528,51 @@ func importTemplatesHandler(c *gin.Context) {
 	}
 
 	// 应用导入数据
-	for _, categoryKey := range targetCategories {
-		if importedCategory, exists := importedData.Categories[categoryKey]; exists {
-			if currentTemplates.Categories == nil {
-				currentTemplates.Categories = make(map[string]Category)
-			}
-
-			currentCategory := currentTemplates.Categories[categoryKey]
-
-			if importMode == "replace" {
-				// 替换模式：完全替换栏目内容
-				currentCategory.Templates = importedCategory.Templates
-				addedCount += len(importedCategory.Templates)
-			} else {
-				// 追加模式：添加新内容，跳过重复
-				for _, newTemplate := range importedCategory.Templates {
-					isExisting := false
-					// 检查是否重复（只比较内容）
-					for _, existingTemplate := range currentCategory.Templates {
-						if strings.TrimSpace(existingTemplate.Content) == strings.TrimSpace(newTemplate.Content) {
-							isExisting = true
-							duplicateCount++
-							break
+	err = room.templates.Update(func(currentTemplates *TemplatesConfig) error {
+		for _, categoryKey := range targetCategories {
+			if importedCategory, exists := importedData.Categories[categoryKey]; exists {
+				currentCategory := currentTemplates.Categories[categoryKey]
+
+				if importMode == "replace" {
+					// 替换模式：完全替换栏目内容
+					currentCategory.Templates = importedCategory.Templates
+					addedCount += len(importedCategory.Templates)
+				} else {
+					// 追加模式：添加新内容，跳过重复
+					for _, newTemplate := range importedCategory.Templates {
+						isExisting := false
+						// 检查是否重复（只比较内容）
+						for _, existingTemplate := range currentCategory.Templates {
+							if strings.TrimSpace(existingTemplate.Content) == strings.TrimSpace(newTemplate.Content) {
+								isExisting = true
+								duplicateCount++
+								break
+							}
+						}
+						if !isExisting {
+							currentCategory.Templates = append(currentCategory.Templates, newTemplate)
+							addedCount++
 						}
-					}
-					if !isExisting {
-						currentCategory.Templates = append(currentCategory.Templates, newTemplate)
-						addedCount++
 					}
 				}
-			}
 
-			currentTemplates.Categories[categoryKey] = currentCategory
+				currentTemplates.Categories[categoryKey] = currentCategory
+			}
 		}
-	}
-
-	// 保存更新后的模板数据
-	err = saveTemplates(currentTemplates)
+		return nil
+	})
 	if err != nil {
+		log.Printf("❌ 保存模板失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存模板数据失败"})
 		return
 	}
 
+	room.broadcastMessage("templates_updated", map[string]interface{}{
+		"action":     "import",
+		"mode":       importMode,
+		"categories": targetCategories,
+	})
+
 	// 构建成功消息
 	var message string
 	if importMode == "replace" {
@@ -1766,7 +2216,80 @@ func lanCheckHandler(c *gin.Context) {
 	})
 }
 
+// 注册房间内的路由，处理函数通过 roomFrom 取得当前房间
+func registerRoomRoutes(g *gin.RouterGroup) {
+	// WebSocket路由
+	g.GET("/ws", handleWebSocket)
+
+	// HTTP路由
+	g.GET("/", indexHandler)
+	g.GET("/qr-code", qrCodeHandler)
+	g.POST("/add", addMessageHandler)
+	g.POST("/delete", deleteMessageHandler)
+	g.POST("/upload", uploadFileHandler)
+	g.POST("/file_received", fileReceivedHandler)
+	g.GET("/files", listFilesHandler)
+	g.GET("/files/:id", downloadFileHandler)
+	g.HEAD("/files/:id", downloadFileHandler)
+	g.DELETE("/files/:id", deleteFileHandler)
+	g.POST("/uploads", createChunkedUploadHandler)
+	g.GET("/uploads/:id", getChunkedUploadHandler)
+	g.PUT("/uploads/:id/chunks/:index", uploadChunkHandler)
+	g.POST("/uploads/:id/complete", completeChunkedUploadHandler)
+	g.DELETE("/uploads/:id", abortChunkedUploadHandler)
+
+	// API路由
+	g.GET("/api/templates", getTemplatesHandler)
+	g.POST("/api/templates", updateTemplatesHandler)
+	g.GET("/api/templates/search", searchTemplatesHandler)
+	g.POST("/api/templates/category/:categoryKey", addTemplateToCategoryHandler)
+	g.GET("/api/templates/export/:formatType", exportTemplatesHandler)
+	g.POST("/api/templates/import", importTemplatesHandler)
+	g.GET("/api/messages", listMessagesAPIHandler)
+	g.POST("/api/messages", createMessageAPIHandler)
+	g.GET("/api/messages/search", searchMessagesAPIHandler)
+	g.GET("/api/messages/trash", listTrashAPIHandler)
+	g.DELETE("/api/messages/trash/:id", purgeMessageAPIHandler)
+	g.GET("/api/messages/:id", getMessageAPIHandler)
+	g.PUT("/api/messages/:id", editMessageAPIHandler)
+	g.GET("/api/messages/:id/revisions", messageRevisionsAPIHandler)
+	g.POST("/api/messages/:id/restore", restoreMessageAPIHandler)
+	g.POST("/api/messages/:id/pin", messageFlagAPIHandler("pin"))
+	g.POST("/api/messages/:id/star", messageFlagAPIHandler("star"))
+	g.PUT("/api/messages/:id/tags", setMessageTagsAPIHandler)
+	g.DELETE("/api/messages/:id", deleteMessageAPIHandler)
+	g.GET("/api/tags", listTagsHandler)
+	g.POST("/api/pairing", createPairingHandler)
+}
+
 func main() {
+	flag.StringVar(&uploadDir, "upload-dir", uploadDir, "上传文件保存目录")
+	flag.StringVar(&roomsDir, "rooms-dir", roomsDir, "其他房间的数据目录")
+	flag.Int64Var(&maxUploadSize, "max-upload-size", maxUploadSize, "单个文件最大字节数")
+	flag.Int64Var(&maxChunkedUploadSize, "max-chunked-upload-size", maxChunkedUploadSize, "分片上传单个文件最大字节数")
+	flag.DurationVar(&trashRetention, "trash-retention", trashRetention, "已删除消息在回收站中的保留时间")
+	flag.IntVar(&maxMessages, "max-messages", maxMessages, "最多保留的消息条数，0 表示不限制")
+	flag.IntVar(&maxMessageDays, "max-message-days", maxMessageDays, "消息最多保留的天数，0 表示不限制")
+	setPassword := flag.String("set-password", "", "设置访问密码（只保存哈希），之后访问需要登录")
+	clearPassword := flag.Bool("clear-password", false, "取消访问密码")
+	flag.BoolVar(&authSkipLAN, "auth-skip-lan", authSkipLAN, "局域网内通过IP直接访问时不需要登录")
+	flag.DurationVar(&loginSessionTTL, "session-ttl", loginSessionTTL, "登录会话的有效期")
+	flag.DurationVar(&deviceCredentialTTL, "device-credential-ttl", deviceCredentialTTL, "扫码配对设备凭据的有效期")
+	trustedProxiesFlag := flag.String("trusted-proxies", "", "可信的反向代理地址（逗号分隔的 IP 或网段），只有来自这些地址的 X-Forwarded-For 才会被采信")
+	guestRoleFlag := flag.String("guest-role", string(guestRole), "未设置密码或局域网免登录时的角色：viewer、sender、editor")
+	flag.Parse()
+
+	role, err := parseRole(*guestRoleFlag)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	guestRole = role
+	for _, proxy := range strings.Split(*trustedProxiesFlag, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+
 	// 设置中国时区 (UTC+8) - 强制设置
 	loc, err := time.LoadLocation("Asia/Shanghai")
 	if err != nil {
@@ -1791,22 +2314,72 @@ func main() {
 	}
 	ln.Close()
 
-	// 确保模板文件存在
-	if err := ensureTemplatesFile(); err != nil {
-		log.Printf("❌ 创建模板文件失败: %v", err)
+	auth, err = newAuthManager(AuthFile)
+	if err != nil {
+		log.Fatalf("❌ 加载访问密码配置失败: %v", err)
+	}
+	switch {
+	case *clearPassword:
+		if err := auth.SetPassword(""); err != nil {
+			log.Fatalf("❌ 取消访问密码失败: %v", err)
+		}
+		log.Printf("🔓 已取消访问密码")
+	case *setPassword != "":
+		if err := auth.SetPassword(*setPassword); err != nil {
+			log.Fatalf("❌ 设置访问密码失败: %v", err)
+		}
+		log.Printf("🔒 访问密码已设置，之前的登录会话已失效")
+	}
+	if auth.Enabled() {
+		log.Printf("🔒 已启用访问密码 (局域网免登录: %v)", authSkipLAN)
+	}
+	if guestRole != RoleEditor {
+		log.Printf("🔑 未登录访问的角色: %s", guestRole)
+	}
+
+	credentials, err = newCredentialRegistry(CredentialsFile)
+	if err != nil {
+		log.Fatalf("❌ 加载设备凭据失败: %v", err)
+	}
+
+	devices, err = newDeviceRegistry(DevicesFile)
+	if err != nil {
+		log.Fatalf("❌ 加载设备列表失败: %v", err)
+	}
+	devices.StartFlusher(deviceFlushInterval, nil)
+
+	// 加载所有房间的存储并启动各自的WebSocket连接中心，之后所有读写都走内存缓存；
+	// 默认房间使用原来的数据文件
+	rooms, err = newRoomRegistry(RoomsFile, roomsDir, roomPaths{
+		dataFile:      DataFile,
+		journalFile:   JournalFile,
+		templatesFile: TemplatesFile,
+		uploadDir:     uploadDir,
+	})
+	if err != nil {
+		log.Fatalf("❌ 加载房间失败: %v", err)
+	}
+	for _, room := range rooms.List() {
+		log.Printf("✅ 房间 %s (%s) 已加载 %d 条消息", room.Name, room.Title, len(room.messages.List()))
 	}
 
 	// 设置Gin模式
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("❌ 可信代理地址无效: %v", err)
+	}
 
 	// 配置CORS
 	config := cors.DefaultConfig()
-	config.AllowAllOrigins = true
+	config.AllowOriginFunc = allowCORSOrigin
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"*"}
 	r.Use(cors.New(config))
 
+	// 访问密码，未设置时不做检查
+	r.Use(authMiddleware)
+
 	// 加载HTML模板
 	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
 		"safeHTML": func(s string) template.HTML {
@@ -1815,15 +2388,26 @@ func main() {
 	}).ParseGlob("templates/*"))
 	r.SetHTMLTemplate(tmpl)
 
-	// 静态文件服务
-	r.Static("/static", "./static")
-
-	// WebSocket路由
-	r.GET("/ws", handleWebSocket)
-
-	// HTTP路由
-	r.GET("/", indexHandler)
-	r.GET("/qr-code", qrCodeHandler)
+	// 静态文件服务（支持 Range 和 ETag）
+	static := newStaticServer("./static")
+	r.GET("/static/*filepath", static.Handle)
+	r.HEAD("/static/*filepath", static.Handle)
+
+	// 登录
+	r.GET("/login", loginPageHandler)
+	r.POST("/login", loginHandler)
+	r.POST("/api/login", loginHandler)
+	r.POST("/logout", logoutHandler)
+
+	// 扫码配对和设备凭据管理
+	r.GET("/pair", pairPageHandler)
+	r.POST("/pair", pairConfirmHandler)
+	r.POST("/api/pair", pairAPIHandler)
+	r.GET("/api/credentials", listCredentialsHandler)
+	r.PUT("/api/credentials/:id", updateCredentialRoleHandler)
+	r.DELETE("/api/credentials/:id", revokeCredentialHandler)
+
+	// 调试和检测页面（与房间无关）
 	r.GET("/test-qr", testQRHandler)                          // 新增：二维码测试页面
 	r.GET("/test-lan", testLANHandler)                        // 新增：局域网检测测试页面
 	r.GET("/test-domain", testDomainHandler)                  // 新增：域名检测测试页面
@@ -1833,18 +2417,18 @@ func main() {
 	r.GET("/host-analysis", hostAnalysisHandler)              // 新增：Host头行为分析页面
 	r.GET("/debug-lan-detection", debugLanDetectionHandler)   // 新增：局域网检测深度调试页面
 	r.GET("/smart-detection-help", smartDetectionHelpHandler) // 新增：智能检测帮助页面
-	r.POST("/add", addMessageHandler)
-	r.POST("/delete", deleteMessageHandler)
-	r.POST("/upload", uploadFileHandler)
-	r.POST("/file_received", fileReceivedHandler)
 
-	// API路由
-	r.GET("/api/templates", getTemplatesHandler)
-	r.POST("/api/templates", updateTemplatesHandler)
-	r.POST("/api/templates/category/:categoryKey", addTemplateToCategoryHandler)
-	r.GET("/api/templates/export/:formatType", exportTemplatesHandler)
-	r.POST("/api/templates/import", importTemplatesHandler)
+	// 全局API：局域网检测、设备和房间管理
 	r.GET("/api/lan-check", lanCheckHandler) // 新增局域网检测API
+	r.GET("/api/devices", listDevicesHandler)
+	r.PUT("/api/devices/:id", renameDeviceHandler)
+	r.GET("/api/rooms", listRoomsHandler)
+	r.POST("/api/rooms", createRoomHandler)
+	r.DELETE("/api/rooms/:name", deleteRoomHandler)
+
+	// 房间内的页面和API：根路径为默认房间，/r/:room 为指定房间
+	registerRoomRoutes(r.Group("/", withRoom(rooms.Default())))
+	registerRoomRoutes(r.Group("/r/:room", roomMiddleware))
 
 	// 获取本机IP
 	localIP := getLocalIP()
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 解码 ULID 前10个字符中的毫秒时间戳
+func ulidMillis(t *testing.T, id string) int64 {
+	t.Helper()
+	var ms int64
+	for _, c := range id[:10] {
+		i := strings.IndexRune(ulidAlphabet, c)
+		if i < 0 {
+			t.Fatalf("%s 含有非法字符 %q", id, c)
+		}
+		ms = ms<<5 | int64(i)
+	}
+	return ms
+}
+
+func TestNewULIDFormat(t *testing.T) {
+	times := []time.Time{
+		time.UnixMilli(0),
+		time.UnixMilli(1),
+		time.Date(2025, 9, 10, 22, 28, 12, 345000000, time.UTC),
+		time.UnixMilli(1<<48 - 1), // 48位时间戳的最大值
+	}
+	for _, ts := range times {
+		id := newULID(ts)
+		if len(id) != 26 {
+			t.Fatalf("newULID(%v) = %q，长度 %d，期望 26", ts, id, len(id))
+		}
+		for _, c := range id {
+			if !strings.ContainsRune(ulidAlphabet, c) {
+				t.Fatalf("newULID(%v) = %q 含有非法字符 %q", ts, id, c)
+			}
+		}
+		if got := ulidMillis(t, id); got != ts.UnixMilli() {
+			t.Errorf("newULID(%v) 的时间戳 = %d，期望 %d", ts, got, ts.UnixMilli())
+		}
+	}
+}
+
+// 不同毫秒生成的ID按时间排序；同一毫秒内是随机顺序，不做保证
+func TestNewULIDOrdering(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		earlier, later time.Time
+	}{
+		{"相差1毫秒", base, base.Add(time.Millisecond)},
+		{"相差1秒", base, base.Add(time.Second)},
+		{"跨年", base.Add(-time.Millisecond), base},
+		{"相差很久", time.UnixMilli(1), base},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				a, b := newULID(tt.earlier), newULID(tt.later)
+				if a >= b {
+					t.Fatalf("newULID(%v) = %s 不小于 newULID(%v) = %s", tt.earlier, a, tt.later, b)
+				}
+			}
+		})
+	}
+}
+
+func TestNewULIDUnique(t *testing.T) {
+	ts := time.Now()
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		id := newULID(ts)
+		if seen[id] {
+			t.Fatalf("同一毫秒内生成了重复的ID %s", id)
+		}
+		seen[id] = true
+	}
+}
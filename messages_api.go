@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 消息 REST API
+//
+// GET    /api/messages         分页获取消息（最新的在前），支持 limit / cursor / since / until
+// POST   /api/messages         JSON 提交新消息 {"content": "...", "targets": ["设备ID"], "ttl": "10m"}
+// GET    /api/messages/:id     获取单条消息
+// PUT    /api/messages/:id     修改消息内容 {"content": "..."}
+// GET    /api/messages/:id/revisions  获取消息的所有版本
+// DELETE /api/messages/:id     删除指定消息（移入回收站）
+// GET    /api/messages/trash   回收站中的消息
+// POST   /api/messages/:id/restore    从回收站恢复
+// DELETE /api/messages/trash/:id      从回收站彻底删除
+// POST   /api/messages/:id/pin        切换置顶，可传 {"value": true/false} 直接设置
+// POST   /api/messages/:id/star       切换星标
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 500
+
+	// 每条消息最多保留的历史版本数
+	maxMessageRevisions = 50
+)
+
+// 列表中不返回历史版本，只保留版本号，历史版本通过 revisions 接口获取
+func withoutRevisions(messages []Message) []Message {
+	for i := range messages {
+		messages[i].Revisions = nil
+	}
+	return messages
+}
+
+// 解析时间参数，支持 "2006-01-02 15:04:05"、"2006-01-02"、RFC3339 和 Unix 秒
+func parseTimeParam(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0).In(time.Local), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(time.Local), nil
+	}
+	return time.Time{}, errors.New("无法识别的时间格式: " + value)
+}
+
+// 消息时间（本地时间字符串）转换为 time.Time
+func messageTime(msg Message) (time.Time, bool) {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", msg.Time, time.Local)
+	return t, err == nil
+}
+
+// 获取消息列表
+func listMessagesAPIHandler(c *gin.Context) {
+	room := roomFrom(c)
+	limit := defaultMessagePageSize
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "limit 参数无效"})
+			return
+		}
+		limit = min(n, maxMessagePageSize)
+	}
+
+	var since, until time.Time
+	var err error
+	if v := c.Query("since"); v != "" {
+		if since, err = parseTimeParam(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "since 参数无效"})
+			return
+		}
+	}
+	if v := c.Query("until"); v != "" {
+		if until, err = parseTimeParam(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "until 参数无效"})
+			return
+		}
+	}
+	cursor := c.Query("cursor")
+	tag := normalizeTag(c.Query("tag"))
+
+	messages := visibleMessages(room.messages.List(), requestDeviceID(c))
+	matches := func(msg Message) bool {
+		if tag != "" && !hasTag(msg, tag) {
+			return false
+		}
+		if since.IsZero() && until.IsZero() {
+			return true
+		}
+		t, ok := messageTime(msg)
+		if !ok {
+			return false
+		}
+		return (since.IsZero() || !t.Before(since)) && (until.IsZero() || !t.After(until))
+	}
+
+	// 置顶消息全部放在第一页最前面，不占 limit，也不参与后续分页
+	page := make([]Message, 0, limit)
+	if cursor == "" {
+		for _, msg := range messages {
+			if msg.Pinned && matches(msg) {
+				page = append(page, msg)
+			}
+		}
+	}
+	pinned := len(page)
+
+	// 消息按最新在前存储，游标取上一页最后一条的ID，从它在列表中的位置之后继续。
+	// 同一毫秒内（以及迁移的旧消息同一秒内）生成的 ULID 不保证有序，不能直接按ID大小比较；
+	// 只有游标消息已被删除时才退回按ID比较
+	start := 0
+	byID := false
+	if cursor != "" {
+		byID = true
+		for i, msg := range messages {
+			if msg.ID == cursor {
+				start, byID = i+1, false
+				break
+			}
+		}
+	}
+
+	hasMore := false
+	for _, msg := range messages[start:] {
+		if msg.Pinned {
+			continue
+		}
+		if byID && msg.ID >= cursor {
+			continue
+		}
+		if !matches(msg) {
+			continue
+		}
+		if len(page)-pinned == limit {
+			hasMore = true
+			break
+		}
+		page = append(page, msg)
+	}
+
+	nextCursor := ""
+	if hasMore {
+		nextCursor = page[len(page)-1].ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"messages":    withoutRevisions(page),
+		"count":       len(page),
+		"has_more":    hasMore,
+		"next_cursor": nextCursor,
+	})
+}
+
+// 获取单条消息
+func getMessageAPIHandler(c *gin.Context) {
+	room := roomFrom(c)
+	msg, ok := room.messages.Get(c.Param("id"))
+	if ok && visibleTo(msg.Targets, msg.SenderDevice, requestDeviceID(c)) {
+		msg.Revisions = nil
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": msg})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+}
+
+// 修改消息内容
+func editMessageAPIHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "编辑消息") {
+		return
+	}
+	room := roomFrom(c)
+	var requestData struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+
+	content := strings.TrimSpace(requestData.Content)
+	if content == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "内容不能为空"})
+		return
+	}
+
+	deviceID := requestDeviceID(c)
+	msg, ok := room.messages.Get(c.Param("id"))
+	if !ok || !visibleTo(msg.Targets, msg.SenderDevice, deviceID) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+		return
+	}
+
+	edited, changed, err := room.editMessage(msg.ID, content, deviceID)
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存消息失败"})
+		return
+	}
+
+	edited.Revisions = nil
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": edited, "changed": changed})
+}
+
+// 获取消息的所有版本（从旧到新，最后一个为当前版本）
+func messageRevisionsAPIHandler(c *gin.Context) {
+	room := roomFrom(c)
+	msg, ok := room.messages.Get(c.Param("id"))
+	if !ok || !visibleTo(msg.Targets, msg.SenderDevice, requestDeviceID(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+		return
+	}
+
+	// msg.Revisions 与存储共用底层数组，先复制再追加，避免不加锁写入存储的内存
+	revisions := append(append([]MessageRevision(nil), msg.Revisions...), currentRevision(msg))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"id":        msg.ID,
+		"revisions": revisions,
+		"count":     len(revisions),
+	})
+}
+
+// 发送新消息
+func createMessageAPIHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "发送消息") {
+		return
+	}
+	room := roomFrom(c)
+	var requestData struct {
+		Content string   `json:"content"`
+		Targets []string `json:"targets"`
+		TTL     string   `json:"ttl"`
+		Tags    []string `json:"tags"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+
+	content := strings.TrimSpace(requestData.Content)
+	if content == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "内容不能为空"})
+		return
+	}
+
+	expiresAt, err := parseMessageTTL(requestData.TTL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	newMessage, deliveries, err := room.createMessage(Message{
+		Content:      content,
+		SenderDevice: requestDeviceID(c),
+		Targets:      parseTargets(requestData.Targets),
+		ExpiresAt:    expiresAt,
+		Tags:         requestData.Tags,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存消息失败"})
+		return
+	}
+
+	c.Header("Location", room.Base()+"/api/messages/"+newMessage.ID)
+	c.JSON(http.StatusCreated, gin.H{"success": true, "message": newMessage, "deliveries": deliveries})
+}
+
+// 删除指定消息
+func deleteMessageAPIHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "删除消息") {
+		return
+	}
+	room := roomFrom(c)
+	messageID := c.Param("id")
+
+	deleted, err := room.removeMessage(messageID, "", requestDeviceID(c))
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "删除消息失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "id": deleted.ID})
+}
+
+// 获取回收站中的消息
+func listTrashAPIHandler(c *gin.Context) {
+	room := roomFrom(c)
+	trashed := visibleMessages(room.messages.Trash(), requestDeviceID(c))
+	c.JSON(http.StatusOK, gin.H{
+		"success":         true,
+		"messages":        withoutRevisions(trashed),
+		"count":           len(trashed),
+		"retention_hours": int(trashRetention.Hours()),
+	})
+}
+
+// 从回收站恢复消息
+func restoreMessageAPIHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "恢复消息") {
+		return
+	}
+	room := roomFrom(c)
+	if msg, ok := room.messages.GetTrashed(c.Param("id")); !ok || !visibleTo(msg.Targets, msg.SenderDevice, requestDeviceID(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "回收站中没有这条消息"})
+		return
+	}
+	restored, err := room.restoreMessage(c.Param("id"))
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "回收站中没有这条消息"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "恢复消息失败"})
+		return
+	}
+
+	restored.Revisions = nil
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": restored})
+}
+
+// 从回收站彻底删除消息
+func purgeMessageAPIHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "彻底删除消息") {
+		return
+	}
+	room := roomFrom(c)
+	if msg, ok := room.messages.GetTrashed(c.Param("id")); !ok || !visibleTo(msg.Targets, msg.SenderDevice, requestDeviceID(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "回收站中没有这条消息"})
+		return
+	}
+	purged, err := room.purgeMessage(c.Param("id"))
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "回收站中没有这条消息"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "删除消息失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "id": purged.ID})
+}
+
+// 切换或设置消息的置顶/星标状态
+func messageFlagAPIHandler(flag string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !requireRole(c, RoleSender, "修改消息的置顶/星标状态") {
+			return
+		}
+		room := roomFrom(c)
+		var requestData struct {
+			Value *bool `json:"value"`
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&requestData); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+				return
+			}
+		}
+
+		msg, ok := room.messages.Get(c.Param("id"))
+		if !ok || !visibleTo(msg.Targets, msg.SenderDevice, requestDeviceID(c)) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+			return
+		}
+
+		updated, err := room.setMessageFlag(msg.ID, flag, requestData.Value)
+		if errors.Is(err, errMessageNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存消息失败"})
+			return
+		}
+
+		updated.Revisions = nil
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": updated})
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 扫码配对：已登录的管理设备生成一次性配对令牌，以二维码形式显示（地址 + 令牌）。
+// 手机扫码打开 /pair?token=... 的确认页面，点击确认（POST /pair）后登记为已配对设备，获得长期有效的设备凭据，
+// 之后不需要再输入密码。凭据以 Cookie（浏览器）或 X-Device-Credential 请求头（其他客户端）提交。
+// 每个凭据带有生成配对码时指定的角色（见 roles.go），管理员可以修改。
+//
+// 配对令牌只保存在内存中，几分钟后过期，使用一次即失效；
+// 设备凭据保存在 CredentialsFile 中，只保存凭据密钥的 SHA-256，吊销后立即失效，
+// 使用该凭据的 WebSocket 连接也会被断开。
+
+const (
+	CredentialsFile = "credentials.json"
+
+	credentialCookieName = "lan_device"
+	credentialHeader     = "X-Device-Credential"
+
+	pairingTokenTTL = 5 * time.Minute
+
+	// 最近使用时间的保存间隔，避免每个请求都写文件
+	credentialTouchInterval = time.Hour
+
+	maxCredentialNameLength = 32
+)
+
+var (
+	errPairingTokenInvalid = errors.New("配对码无效或已过期")
+	errCredentialNotFound  = errors.New("设备凭据不存在")
+)
+
+// 扫码配对得到的设备凭据的有效期，由 -device-credential-ttl 指定
+var deviceCredentialTTL = 365 * 24 * time.Hour
+
+// 一次性配对令牌
+type pairingToken struct {
+	name      string // 配对后设备凭据的名称，为空时使用手机的 UA
+	redirect  string // 配对成功后跳转的页面（生成配对码时所在的房间）
+	createdBy string // 生成配对码的设备ID
+	role      Role
+	expiresAt time.Time
+}
+
+// 已配对设备的凭据，SecretHash 为凭据密钥的 SHA-256
+type DeviceCredential struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Role       Role   `json:"role"`
+	SecretHash string `json:"secret_hash"`
+	DeviceID   string `json:"device_id,omitempty"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"created_at"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	LastUsed   string `json:"last_used"`
+	ExpiresAt  string `json:"expires_at"`
+
+	lastTouched time.Time
+}
+
+// 对外展示的凭据信息，不含密钥哈希
+func (cred DeviceCredential) view() gin.H {
+	return gin.H{
+		"id":          cred.ID,
+		"name":        cred.Name,
+		"role":        cred.Role,
+		"device_id":   cred.DeviceID,
+		"device_name": devices.Name(cred.DeviceID),
+		"user_agent":  cred.UserAgent,
+		"ip":          cred.IP,
+		"created_at":  cred.CreatedAt,
+		"last_used":   cred.LastUsed,
+		"expires_at":  cred.ExpiresAt,
+	}
+}
+
+type credentialRegistry struct {
+	mu          sync.Mutex
+	path        string
+	credentials map[string]*DeviceCredential
+	pairings    map[string]*pairingToken
+}
+
+var credentials *credentialRegistry
+
+func newCredentialRegistry(path string) (*credentialRegistry, error) {
+	r := &credentialRegistry{
+		path:        path,
+		credentials: make(map[string]*DeviceCredential),
+		pairings:    make(map[string]*pairingToken),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var list []*DeviceCredential
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, cred := range list {
+			if cred.Role == "" {
+				cred.Role = RoleSender // 引入角色之前配对的设备
+			}
+			r.credentials[cred.ID] = cred
+		}
+	}
+	return r, nil
+}
+
+func (r *credentialRegistry) saveLocked() error {
+	list := make([]*DeviceCredential, 0, len(r.credentials))
+	for _, cred := range r.credentials {
+		list = append(list, cred)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.path, data, 0600); err != nil {
+		log.Printf("❌ 保存设备凭据失败: %v", err)
+		return err
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// 生成一次性配对令牌
+func (r *credentialRegistry) CreatePairing(name, redirect, createdBy string, role Role) (string, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for token, p := range r.pairings {
+		if now.After(p.expiresAt) {
+			delete(r.pairings, token)
+		}
+	}
+
+	token := randomHex(16)
+	expires := now.Add(pairingTokenTTL)
+	r.pairings[token] = &pairingToken{name: name, redirect: redirect, createdBy: createdBy, role: role, expiresAt: expires}
+	return token, expires
+}
+
+// 用配对令牌换取设备凭据，令牌随即失效。返回凭据、凭据字符串（ID.密钥）和配对后跳转的页面
+// 查看配对令牌是否有效，不消耗令牌
+func (r *credentialRegistry) PairingRole(token string) (Role, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pairings[token]
+	if !ok || time.Now().After(p.expiresAt) {
+		return "", false
+	}
+	return p.role, true
+}
+
+func (r *credentialRegistry) Pair(token, name, deviceID, ip, userAgent string) (*DeviceCredential, string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.pairings[token]
+	if !ok {
+		return nil, "", "", errPairingTokenInvalid
+	}
+	delete(r.pairings, token)
+	if time.Now().After(p.expiresAt) {
+		return nil, "", "", errPairingTokenInvalid
+	}
+
+	if name == "" {
+		name = p.name
+	}
+	if name == "" {
+		name = userAgent
+	}
+	if runes := []rune(name); len(runes) > maxCredentialNameLength {
+		name = string(runes[:maxCredentialNameLength])
+	}
+
+	now := time.Now()
+	secret := randomHex(32)
+	cred := &DeviceCredential{
+		ID:          newULID(now),
+		Name:        name,
+		Role:        p.role,
+		SecretHash:  hashSecret(secret),
+		DeviceID:    deviceID,
+		UserAgent:   userAgent,
+		IP:          ip,
+		CreatedAt:   now.In(time.Local).Format("2006-01-02 15:04:05"),
+		CreatedBy:   p.createdBy,
+		LastUsed:    now.In(time.Local).Format("2006-01-02 15:04:05"),
+		ExpiresAt:   now.Add(deviceCredentialTTL).In(time.Local).Format("2006-01-02 15:04:05"),
+		lastTouched: now,
+	}
+	r.credentials[cred.ID] = cred
+	if err := r.saveLocked(); err != nil {
+		delete(r.credentials, cred.ID)
+		return nil, "", "", err
+	}
+	return cred, cred.ID + "." + secret, p.redirect, nil
+}
+
+// 校验凭据字符串，有效时返回凭据
+func (r *credentialRegistry) Authenticate(value string) (DeviceCredential, bool) {
+	id, secret, ok := strings.Cut(value, ".")
+	if !ok {
+		return DeviceCredential{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cred, ok := r.credentials[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(cred.SecretHash)) != 1 {
+		return DeviceCredential{}, false
+	}
+	now := time.Now()
+	if expires, err := time.ParseInLocation("2006-01-02 15:04:05", cred.ExpiresAt, time.Local); err == nil && now.After(expires) {
+		return DeviceCredential{}, false
+	}
+
+	cred.LastUsed = now.In(time.Local).Format("2006-01-02 15:04:05")
+	if now.Sub(cred.lastTouched) > credentialTouchInterval {
+		cred.lastTouched = now
+		r.saveLocked()
+	}
+	return *cred, true
+}
+
+// 所有设备凭据，最近配对的在前
+func (r *credentialRegistry) List() []DeviceCredential {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]DeviceCredential, 0, len(r.credentials))
+	for _, cred := range r.credentials {
+		list = append(list, *cred)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list
+}
+
+// 修改设备凭据的角色，立即对之后的请求生效
+func (r *credentialRegistry) SetRole(id string, role Role) (DeviceCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cred, ok := r.credentials[id]
+	if !ok {
+		return DeviceCredential{}, errCredentialNotFound
+	}
+	previous := cred.Role
+	cred.Role = role
+	if err := r.saveLocked(); err != nil {
+		cred.Role = previous
+		return DeviceCredential{}, err
+	}
+	return *cred, nil
+}
+
+// 吊销设备凭据
+func (r *credentialRegistry) Revoke(id string) (DeviceCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cred, ok := r.credentials[id]
+	if !ok {
+		return DeviceCredential{}, errCredentialNotFound
+	}
+	delete(r.credentials, id)
+	if err := r.saveLocked(); err != nil {
+		r.credentials[id] = cred
+		return DeviceCredential{}, err
+	}
+	return *cred, nil
+}
+
+// 请求携带的设备凭据：优先 X-Device-Credential 请求头，其次 Cookie
+func requestCredential(c *gin.Context) string {
+	if value := strings.TrimSpace(c.GetHeader(credentialHeader)); value != "" {
+		return value
+	}
+	if value, err := c.Cookie(credentialCookieName); err == nil {
+		return value
+	}
+	return ""
+}
+
+// 请求方使用的有效设备凭据
+func requestDeviceCredential(c *gin.Context) (DeviceCredential, bool) {
+	value := requestCredential(c)
+	if value == "" {
+		return DeviceCredential{}, false
+	}
+	return credentials.Authenticate(value)
+}
+
+// 是否为管理员：未设置密码时所有人都是管理员，否则需要用密码登录（配对设备不是管理员）
+func isAdmin(c *gin.Context) bool {
+	return !auth.Enabled() || auth.Authenticated(c)
+}
+
+func requireAdmin(c *gin.Context, action string) bool {
+	if isAdmin(c) {
+		return true
+	}
+	log.Printf("⛔ 拒绝%s: %s 不是管理员", action, c.ClientIP())
+	c.JSON(http.StatusForbidden, gin.H{"success": false, "error": "只有用密码登录的管理员可以" + action})
+	return false
+}
+
+// 生成配对码 {"name": "小明的手机", "role": "sender"}，返回配对地址和二维码。角色默认为 sender
+func createPairingHandler(c *gin.Context) {
+	if !requireAdmin(c, "生成配对码") {
+		return
+	}
+	var requestData struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&requestData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+			return
+		}
+	}
+	role := RoleSender
+	if requestData.Role != "" {
+		var err error
+		if role, err = parseRole(requestData.Role); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+	}
+
+	room := roomFrom(c)
+	token, expires := credentials.CreatePairing(strings.TrimSpace(requestData.Name), room.Base()+"/", requestDeviceID(c), role)
+	qrDataURL, pairURL, _ := generateQRCode(c.Request, "/pair?token="+url.QueryEscape(token))
+	log.Printf("📱 已生成配对码（角色 %s），%v 内有效", role, pairingTokenTTL)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"token":       token,
+		"role":        role,
+		"url":         pairURL,
+		"qr_data_url": qrDataURL,
+		"expires_at":  expires.In(time.Local).Format("2006-01-02 15:04:05"),
+		"expires_in":  int(pairingTokenTTL.Seconds()),
+	})
+}
+
+func setCredentialCookie(c *gin.Context, value string) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     credentialCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(deviceCredentialTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// 扫码后打开的确认页面。GET 不消耗配对码，避免链接预览和扫码软件的预加载把配对码用掉
+func pairPageHandler(c *gin.Context) {
+	token := c.Query("token")
+	role, ok := credentials.PairingRole(token)
+	if !ok {
+		log.Printf("⚠️ 配对码无效 (%s)", c.ClientIP())
+		c.HTML(http.StatusBadRequest, "login.html", gin.H{"next": "/", "error": errPairingTokenInvalid.Error()})
+		return
+	}
+	c.HTML(http.StatusOK, "pair.html", gin.H{"token": token, "role": role.DisplayName()})
+}
+
+// 确认页面提交后换取设备凭据，写入 Cookie 后跳转到主页
+func pairConfirmHandler(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	cred, value, redirect, err := credentials.Pair(c.PostForm("token"), name, requestDeviceID(c), c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		log.Printf("⚠️ 配对失败 (%s): %v", c.ClientIP(), err)
+		c.HTML(http.StatusBadRequest, "login.html", gin.H{"next": "/", "error": errPairingTokenInvalid.Error()})
+		return
+	}
+	setCredentialCookie(c, value)
+	log.Printf("✅ 设备已配对: %s (%s, %s)", cred.Name, cred.ID, cred.IP)
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// 非浏览器客户端配对 {"token": "...", "name": "..."}，返回凭据字符串，之后放在 X-Device-Credential 请求头中
+func pairAPIHandler(c *gin.Context) {
+	var requestData struct {
+		Token string `json:"token"`
+		Name  string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+
+	cred, value, _, err := credentials.Pair(requestData.Token, strings.TrimSpace(requestData.Name), requestDeviceID(c), c.ClientIP(), c.Request.UserAgent())
+	if errors.Is(err, errPairingTokenInvalid) {
+		log.Printf("⚠️ 配对失败 (%s): %v", c.ClientIP(), err)
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存设备凭据失败"})
+		return
+	}
+	setCredentialCookie(c, value)
+	log.Printf("✅ 设备已配对: %s (%s, %s)", cred.Name, cred.ID, cred.IP)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"credential": value,
+		"device":     cred.view(),
+	})
+}
+
+// 已配对设备列表
+func listCredentialsHandler(c *gin.Context) {
+	if !requireAdmin(c, "查看配对设备") {
+		return
+	}
+	list := credentials.List()
+	result := make([]gin.H, 0, len(list))
+	for _, cred := range list {
+		result = append(result, cred.view())
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "credentials": result, "count": len(result)})
+}
+
+// 修改配对设备的角色 {"role": "viewer"}
+func updateCredentialRoleHandler(c *gin.Context) {
+	if !requireAdmin(c, "修改配对设备的角色") {
+		return
+	}
+	var requestData struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+	role, err := parseRole(requestData.Role)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	cred, err := credentials.SetRole(c.Param("id"), role)
+	if errors.Is(err, errCredentialNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存设备凭据失败"})
+		return
+	}
+
+	log.Printf("🔑 设备 %s (%s) 的角色已改为 %s", cred.Name, cred.ID, role)
+	c.JSON(http.StatusOK, gin.H{"success": true, "credential": cred.view()})
+}
+
+// 吊销设备凭据，并断开使用该凭据的连接
+func revokeCredentialHandler(c *gin.Context) {
+	if !requireAdmin(c, "吊销配对设备") {
+		return
+	}
+	cred, err := credentials.Revoke(c.Param("id"))
+	if errors.Is(err, errCredentialNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存设备凭据失败"})
+		return
+	}
+
+	rooms.DisconnectCredential(cred.ID)
+	log.Printf("🚫 设备凭据已吊销: %s (%s)", cred.Name, cred.ID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "id": cred.ID})
+}
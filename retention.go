@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 消息保留策略：
+//   - -max-messages：只保留最新的 N 条消息
+//   - -max-message-days：删除早于 D 天的消息
+//   - 每条消息可以单独设置 ttl（如 "10m"，或秒数），到期后自动销毁，适合一次性验证码
+// 清理任务定期执行，删除的消息不进回收站，并广播 message_deleted 让各设备同步移除。
+
+const (
+	// 清理任务的执行间隔，决定阅后即焚的精度
+	messageJanitorInterval = 10 * time.Second
+
+	// 单条消息允许设置的最长有效期
+	maxMessageTTL = 30 * 24 * time.Hour
+)
+
+// 解析消息有效期，支持 Go 时长格式（10m、1h30m）和纯数字秒数，返回到期时间；
+// 为空时表示不过期
+func parseMessageTTL(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return "", nil
+	}
+
+	var ttl time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		ttl = time.Duration(seconds) * time.Second
+	} else if d, err := time.ParseDuration(value); err == nil {
+		ttl = d
+	} else {
+		return "", errors.New("ttl 参数无效: " + value)
+	}
+	if ttl <= 0 || ttl > maxMessageTTL {
+		return "", errors.New("ttl 需在 1 秒到 30 天之间")
+	}
+	return time.Now().Add(ttl).In(time.Local).Format("2006-01-02 15:04:05"), nil
+}
+
+// 后台定期按保留策略清理房间内的消息并广播删除，房间删除后退出
+func (room *Room) startMessageJanitor(interval time.Duration) {
+	maxAge := time.Duration(maxMessageDays) * 24 * time.Hour
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-room.done:
+				return
+			case <-ticker.C:
+			}
+			expired := room.messages.Expire(maxMessages, maxAge)
+			for _, msg := range expired {
+				if msg.DeletedAt != "" {
+					continue // 回收站中的消息客户端本来就看不到
+				}
+				room.sendToDevices("message_deleted", map[string]interface{}{
+					"id":     msg.ID,
+					"time":   msg.Time,
+					"action": "delete",
+					"reason": "expired",
+				}, msg.SenderDevice, msg.Targets)
+			}
+			if len(expired) > 0 {
+				log.Printf("🧹 已按保留策略清理 %d 条消息", len(expired))
+			}
+		}
+	}()
+}
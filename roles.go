@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 角色：附加在登录会话和设备凭据上，由各个处理函数检查。
+//   - viewer（只读）：查看消息、文件和模板
+//   - sender（发送者）：另外可以发送、编辑、删除消息，上传、领取和删除文件
+//   - editor（编辑者）：另外可以修改、导入导出模板，管理房间
+//
+// 用密码登录的会话为 editor；未设置密码或局域网免登录的请求使用 -guest-role（默认 editor，与之前一致）；
+// 扫码配对的设备在生成配对码时指定角色，管理员可以随时修改。
+
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleSender Role = "sender"
+	RoleEditor Role = "editor"
+
+	// 请求方的角色保存在请求上下文中
+	roleContextKey = "role"
+)
+
+// 未设置密码或局域网免登录时的角色，由 -guest-role 指定
+var guestRole = RoleEditor
+
+var roleLevels = map[Role]int{
+	RoleViewer: 1,
+	RoleSender: 2,
+	RoleEditor: 3,
+}
+
+var roleNames = map[Role]string{
+	RoleViewer: "只读",
+	RoleSender: "发送者",
+	RoleEditor: "编辑者",
+}
+
+func parseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := roleLevels[role]; !ok {
+		return "", fmt.Errorf("未知的角色: %q（可选 viewer、sender、editor）", s)
+	}
+	return role, nil
+}
+
+// 角色是否包含另一个角色的全部权限
+func (r Role) Allows(required Role) bool {
+	return roleLevels[r] >= roleLevels[required]
+}
+
+func (r Role) DisplayName() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return string(r)
+}
+
+// 请求方的角色，由 authMiddleware 设置；未设置密码时为 guestRole
+func requestRole(c *gin.Context) Role {
+	if role := Role(c.GetString(roleContextKey)); role != "" {
+		return role
+	}
+	return guestRole
+}
+
+// 检查请求方是否有所需角色，没有时记录日志并返回 403
+func requireRole(c *gin.Context, required Role, action string) bool {
+	role := requestRole(c)
+	if role.Allows(required) {
+		return true
+	}
+	who := c.ClientIP()
+	if id := c.GetString(credentialContextKey); id != "" {
+		who += " (设备凭据 " + id + ")"
+	}
+	log.Printf("⛔ 拒绝%s: %s 的角色为 %s，需要 %s", action, who, role, required)
+	c.JSON(http.StatusForbidden, gin.H{
+		"success":  false,
+		"error":    fmt.Sprintf("没有权限%s，需要%s权限", action, required.DisplayName()),
+		"role":     role,
+		"required": required,
+	})
+	return false
+}
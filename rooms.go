@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 房间：每个房间有独立的消息、模板、上传目录和 WebSocket 连接中心，互不可见。
+//
+// 默认房间沿用原来的数据文件（messages.txt、templates_config.json、uploads/），
+// 通过根路径访问，升级前的数据和链接不受影响；其他房间的数据保存在
+// roomsDir/<房间名>/ 下，通过 /r/<房间名>/... 访问，房间列表保存在 RoomsFile 中。
+// 设备登记是全局的，同一设备在各个房间使用相同的设备ID和昵称。
+
+const (
+	RoomsFile = "rooms.json"
+
+	defaultRoomName  = "default"
+	defaultRoomTitle = "默认房间"
+
+	maxRoomTitleLength = 32
+
+	roomContextKey = "room"
+)
+
+var (
+	errRoomNotFound = errors.New("房间不存在")
+	errRoomExists   = errors.New("房间已存在")
+	errRoomName     = errors.New("房间名只能包含小写字母、数字、下划线和连字符，最长32个字符")
+	errDefaultRoom  = errors.New("默认房间不能删除")
+)
+
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+type Room struct {
+	Name      string `json:"name"`
+	Title     string `json:"title"`
+	CreatedAt string `json:"created_at"`
+
+	dir       string // 房间数据目录，默认房间为空
+	messages  *MessageStore
+	templates *TemplateStore
+	files     *FileStore
+	uploads   *uploadManager
+	hub       *Hub
+	done      chan struct{} // 关闭后停止房间的后台任务
+}
+
+// 房间内各数据文件的位置
+type roomPaths struct {
+	dataFile      string
+	journalFile   string
+	templatesFile string
+	uploadDir     string
+}
+
+func roomPathsIn(dir string) roomPaths {
+	return roomPaths{
+		dataFile:      filepath.Join(dir, DataFile),
+		journalFile:   filepath.Join(dir, JournalFile),
+		templatesFile: filepath.Join(dir, TemplatesFile),
+		uploadDir:     filepath.Join(dir, "uploads"),
+	}
+}
+
+// 房间的 URL 前缀，默认房间为空
+func (room *Room) Base() string {
+	if room.Name == defaultRoomName {
+		return ""
+	}
+	return "/r/" + room.Name
+}
+
+// 加载房间数据并启动连接中心和后台任务
+func openRoom(room *Room, paths roomPaths) error {
+	if room.dir != "" {
+		if err := os.MkdirAll(room.dir, 0755); err != nil {
+			return err
+		}
+	}
+	var err error
+	if err = ensureTemplatesFile(paths.templatesFile); err != nil {
+		log.Printf("❌ 创建模板文件失败: %v", err)
+	}
+	if room.messages, err = newMessageStore(paths.dataFile, paths.journalFile); err != nil {
+		return err
+	}
+	if room.templates, err = newTemplateStore(paths.templatesFile); err != nil {
+		room.messages.Close()
+		return err
+	}
+	if room.files, err = newFileStore(paths.uploadDir, room.Base()); err != nil {
+		room.messages.Close()
+		return err
+	}
+	if room.uploads, err = newUploadManager(paths.uploadDir, room.files); err != nil {
+		room.messages.Close()
+		return err
+	}
+
+	room.hub = newHub(room.messages)
+	room.done = make(chan struct{})
+	go room.hub.Run()
+	room.messages.StartCompactor(10*time.Minute, room.done)
+	room.messages.StartTrashPurger(trashRetention, time.Hour, room.done)
+	room.uploads.StartJanitor(time.Hour, room.done)
+	room.startMessageJanitor(messageJanitorInterval)
+	return nil
+}
+
+// 停止后台任务、断开连接并关闭消息日志
+func (room *Room) close() {
+	close(room.done)
+	room.hub.Stop()
+	if err := room.messages.Close(); err != nil {
+		log.Printf("⚠️ 关闭房间 %s 的消息日志失败: %v", room.Name, err)
+	}
+}
+
+// 广播给房间内所有设备
+func (room *Room) broadcastMessage(msgType string, data interface{}) {
+	room.hub.Broadcast(msgType, data)
+}
+
+// 发送事件：没有目标时广播给房间内所有设备，否则只发给目标设备和发送者，并返回每个目标的投递结果
+func (room *Room) sendToDevices(msgType string, data interface{}, sender string, targets []string) []DeliveryStatus {
+	if len(targets) == 0 {
+		room.hub.Broadcast(msgType, data)
+		return nil
+	}
+	return room.hub.SendTo(msgType, data, sender, targets)
+}
+
+type roomRegistry struct {
+	mu    sync.RWMutex
+	path  string // 房间列表文件
+	dir   string // 各房间数据目录的上级目录
+	rooms map[string]*Room
+}
+
+// 加载默认房间和房间列表中的所有房间，defaultPaths 为默认房间的数据位置
+func newRoomRegistry(path, dir string, defaultPaths roomPaths) (*roomRegistry, error) {
+	r := &roomRegistry{path: path, dir: dir, rooms: make(map[string]*Room)}
+
+	def := &Room{Name: defaultRoomName, Title: defaultRoomTitle}
+	if err := openRoom(def, defaultPaths); err != nil {
+		return nil, err
+	}
+	r.rooms[def.Name] = def
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var list []*Room
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, room := range list {
+			if !roomNamePattern.MatchString(room.Name) || room.Name == defaultRoomName {
+				log.Printf("⚠️ 房间名 %q 无效，已跳过", room.Name)
+				continue
+			}
+			room.dir = filepath.Join(dir, room.Name)
+			if err := openRoom(room, roomPathsIn(room.dir)); err != nil {
+				return nil, err
+			}
+			r.rooms[room.Name] = room
+		}
+	}
+	return r, nil
+}
+
+func (r *roomRegistry) Get(name string) (*Room, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	room, ok := r.rooms[name]
+	return room, ok
+}
+
+func (r *roomRegistry) Default() *Room {
+	room, _ := r.Get(defaultRoomName)
+	return room
+}
+
+// 所有房间，默认房间在最前，其余按创建时间排列
+func (r *roomRegistry) List() []*Room {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]*Room, 0, len(r.rooms))
+	for _, room := range r.rooms {
+		list = append(list, room)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].Name == defaultRoomName) != (list[j].Name == defaultRoomName) {
+			return list[i].Name == defaultRoomName
+		}
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt < list[j].CreatedAt
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (r *roomRegistry) Create(name, title string) (*Room, error) {
+	if !roomNamePattern.MatchString(name) {
+		return nil, errRoomName
+	}
+	if title == "" {
+		title = name
+	}
+	if runes := []rune(title); len(runes) > maxRoomTitleLength {
+		title = string(runes[:maxRoomTitleLength])
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.rooms[name]; ok {
+		return nil, errRoomExists
+	}
+
+	room := &Room{
+		Name:      name,
+		Title:     title,
+		CreatedAt: time.Now().In(time.Local).Format("2006-01-02 15:04:05"),
+		dir:       filepath.Join(r.dir, name),
+	}
+	if err := openRoom(room, roomPathsIn(room.dir)); err != nil {
+		return nil, err
+	}
+	r.rooms[name] = room
+	if err := r.saveLocked(); err != nil {
+		delete(r.rooms, name)
+		room.close()
+		return nil, err
+	}
+	return room, nil
+}
+
+// 删除房间及其全部数据，房间内的连接会收到 room_deleted 后被断开
+func (r *roomRegistry) Delete(name string) (*Room, error) {
+	if name == defaultRoomName {
+		return nil, errDefaultRoom
+	}
+
+	r.mu.Lock()
+	room, ok := r.rooms[name]
+	if !ok {
+		r.mu.Unlock()
+		return nil, errRoomNotFound
+	}
+	delete(r.rooms, name)
+	if err := r.saveLocked(); err != nil {
+		r.rooms[name] = room
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.mu.Unlock()
+
+	room.broadcastMessage("room_deleted", map[string]interface{}{"name": room.Name, "title": room.Title})
+	room.close()
+	if err := os.RemoveAll(room.dir); err != nil {
+		log.Printf("⚠️ 删除房间 %s 的数据目录失败: %v", room.Name, err)
+	}
+	return room, nil
+}
+
+// 广播给所有房间的连接（设备上下线、房间列表变化）
+func (r *roomRegistry) Broadcast(msgType string, data interface{}) {
+	for _, room := range r.List() {
+		room.broadcastMessage(msgType, data)
+	}
+}
+
+// 断开所有房间中使用指定设备凭据的连接
+func (r *roomRegistry) DisconnectCredential(credentialID string) {
+	for _, room := range r.List() {
+		room.hub.DisconnectCredential(credentialID)
+	}
+}
+
+// 保存房间列表（不含默认房间）
+func (r *roomRegistry) saveLocked() error {
+	list := make([]*Room, 0, len(r.rooms))
+	for _, room := range r.rooms {
+		if room.Name != defaultRoomName {
+			list = append(list, room)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return writeJSONAtomic(r.path, list)
+}
+
+// 把房间放入请求上下文，用于根路径（默认房间）
+func withRoom(room *Room) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(roomContextKey, room)
+		c.Next()
+	}
+}
+
+// 按 /r/:room 中的房间名查找房间
+func roomMiddleware(c *gin.Context) {
+	room, ok := rooms.Get(c.Param("room"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"success": false, "error": errRoomNotFound.Error()})
+		return
+	}
+	c.Set(roomContextKey, room)
+	c.Next()
+}
+
+func roomFrom(c *gin.Context) *Room {
+	return c.MustGet(roomContextKey).(*Room)
+}
+
+func roomSummary(room *Room) gin.H {
+	return gin.H{
+		"name":       room.Name,
+		"title":      room.Title,
+		"created_at": room.CreatedAt,
+		"url":        room.Base() + "/",
+		"messages":   len(room.messages.List()),
+		"files":      len(room.files.List()),
+		"default":    room.Name == defaultRoomName,
+	}
+}
+
+// 房间列表
+func listRoomsHandler(c *gin.Context) {
+	list := rooms.List()
+	result := make([]gin.H, 0, len(list))
+	for _, room := range list {
+		result = append(result, roomSummary(room))
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "rooms": result, "count": len(result)})
+}
+
+// 创建房间 {"name": "work", "title": "工作"}
+func createRoomHandler(c *gin.Context) {
+	if !requireRole(c, RoleEditor, "创建房间") {
+		return
+	}
+	var requestData struct {
+		Name  string `json:"name"`
+		Title string `json:"title"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+
+	room, err := rooms.Create(strings.TrimSpace(requestData.Name), strings.TrimSpace(requestData.Title))
+	switch {
+	case errors.Is(err, errRoomName):
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	case errors.Is(err, errRoomExists):
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("❌ 创建房间失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "创建房间失败"})
+		return
+	}
+
+	log.Printf("✅ 房间已创建: %s (%s)", room.Name, room.Title)
+	rooms.Broadcast("rooms_updated", map[string]interface{}{"action": "create", "name": room.Name})
+	c.JSON(http.StatusCreated, gin.H{"success": true, "room": roomSummary(room)})
+}
+
+// 删除房间及其全部消息、模板和文件
+func deleteRoomHandler(c *gin.Context) {
+	if !requireRole(c, RoleEditor, "删除房间") {
+		return
+	}
+	room, err := rooms.Delete(c.Param("name"))
+	switch {
+	case errors.Is(err, errDefaultRoom):
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	case errors.Is(err, errRoomNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("❌ 删除房间失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "删除房间失败"})
+		return
+	}
+
+	log.Printf("🗑️ 房间已删除: %s (%s)", room.Name, room.Title)
+	rooms.Broadcast("rooms_updated", map[string]interface{}{"action": "delete", "name": room.Name})
+	c.JSON(http.StatusOK, gin.H{"success": true, "name": room.Name})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 消息全文检索（内容和标签）：内存倒排索引，启动时由 MessageStore 从全部消息构建，
+// 之后随新增、编辑、删除（移入回收站）、恢复增量更新。
+//
+// 分词规则：连续的汉字（以及日文假名、韩文）同时切成单字和相邻两字（bigram），
+// 查询两个字以上的中文时用 bigram，单个字时用单字；拉丁字母和数字按单词切分，统一转小写。
+// 多个查询词之间是“与”的关系，按 TF-IDF 打分，同分时新消息在前。
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 200
+
+	// 摘要长度（字符数）和命中位置之前保留的字符数
+	snippetLength = 80
+	snippetLead   = 20
+)
+
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]int // 词 -> 消息ID -> 词频
+	docs     map[string][]string       // 消息ID -> 该消息的所有词（去重），用于删除
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string]int),
+		docs:     make(map[string][]string),
+	}
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// 把文本切分为词。forQuery 为 true 时中文只取 bigram（单字时取单字），
+// 否则同时输出单字和 bigram，保证单字查询也能命中
+func tokenize(text string, forQuery bool) []string {
+	var tokens []string
+	var word []rune
+	var cjk []rune
+
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		if len(cjk) == 0 {
+			return
+		}
+		if !forQuery || len(cjk) == 1 {
+			for _, r := range cjk {
+				tokens = append(tokens, string(r))
+			}
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			tokens = append(tokens, string(cjk[i:i+2]))
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, unicode.ToLower(r))
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return tokens
+}
+
+// 索引一条消息；已在索引中的先移除再重新索引。回收站中的消息不索引
+func (idx *searchIndex) Put(msg Message) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(msg.ID)
+	if msg.DeletedAt != "" {
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, token := range tokenize(msg.Content+" "+strings.Join(msg.Tags, " "), false) {
+		counts[token]++
+	}
+	terms := make([]string, 0, len(counts))
+	for token, n := range counts {
+		docs, ok := idx.postings[token]
+		if !ok {
+			docs = make(map[string]int)
+			idx.postings[token] = docs
+		}
+		docs[msg.ID] = n
+		terms = append(terms, token)
+	}
+	idx.docs[msg.ID] = terms
+}
+
+func (idx *searchIndex) Remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(id)
+}
+
+func (idx *searchIndex) removeLocked(id string) {
+	for _, token := range idx.docs[id] {
+		if docs, ok := idx.postings[token]; ok {
+			delete(docs, id)
+			if len(docs) == 0 {
+				delete(idx.postings, token)
+			}
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// 用全部消息重建索引
+func (idx *searchIndex) Rebuild(messages []Message) {
+	idx.mu.Lock()
+	idx.postings = make(map[string]map[string]int)
+	idx.docs = make(map[string][]string)
+	idx.mu.Unlock()
+
+	for _, msg := range messages {
+		idx.Put(msg)
+	}
+}
+
+type searchHit struct {
+	ID      string
+	Score   float64
+	Message Message // 由 MessageStore.Search 填入
+}
+
+// 查询，返回按得分从高到低排列的消息ID。所有查询词都必须命中
+func (idx *searchIndex) Search(query string) []searchHit {
+	terms := tokenize(query, true)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	total := float64(len(idx.docs))
+	scores := make(map[string]float64)
+	for i, term := range terms {
+		docs := idx.postings[term]
+		if len(docs) == 0 {
+			return nil
+		}
+		idf := math.Log(1+total/float64(len(docs))) + 1
+		next := make(map[string]float64, len(docs))
+		for id, tf := range docs {
+			if score, ok := scores[id]; ok || i == 0 {
+				next[id] = score + float64(tf)*idf
+			}
+		}
+		scores = next
+		if len(scores) == 0 {
+			return nil
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, searchHit{ID: id, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID > hits[j].ID
+	})
+	return hits
+}
+
+// 生成带高亮的摘要：以第一个命中位置为中心截取一段，命中的部分用 <mark> 包裹，
+// 其余内容做 HTML 转义
+func highlightSnippet(content, query string) string {
+	text := []rune(content)
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// 查询按空白和标点拆成若干片段，逐个在原文中查找（不区分大小写）
+	marked := make([]bool, len(text))
+	first := -1
+	for _, term := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !(isCJK(r) || unicode.IsLetter(r) || unicode.IsDigit(r))
+	}) {
+		pattern := []rune(term)
+		for i := 0; i+len(pattern) <= len(lower); i++ {
+			if string(lower[i:i+len(pattern)]) != term {
+				continue
+			}
+			for j := i; j < i+len(pattern); j++ {
+				marked[j] = true
+			}
+			if first == -1 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start := 0
+	if first > snippetLead {
+		start = first - snippetLead
+	}
+	end := min(start+snippetLength, len(text))
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		segment := html.EscapeString(string(text[i:j]))
+		if marked[i] {
+			b.WriteString("<mark>" + segment + "</mark>")
+		} else {
+			b.WriteString(segment)
+		}
+		i = j
+	}
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// 搜索消息：q 为关键词，支持 since / until 时间范围和 limit
+func searchMessagesAPIHandler(c *gin.Context) {
+	room := roomFrom(c)
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "缺少搜索关键词"})
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "limit 参数无效"})
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+
+	var since, until time.Time
+	var err error
+	if v := c.Query("since"); v != "" {
+		if since, err = parseTimeParam(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "since 参数无效"})
+			return
+		}
+	}
+	if v := c.Query("until"); v != "" {
+		if until, err = parseTimeParam(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "until 参数无效"})
+			return
+		}
+	}
+
+	deviceID := requestDeviceID(c)
+	results := make([]gin.H, 0, limit)
+	total := 0
+	for _, hit := range room.messages.Search(query) {
+		msg := hit.Message
+		if !visibleTo(msg.Targets, msg.SenderDevice, deviceID) {
+			continue
+		}
+		if !since.IsZero() || !until.IsZero() {
+			t, ok := messageTime(msg)
+			if !ok || (!since.IsZero() && t.Before(since)) || (!until.IsZero() && t.After(until)) {
+				continue
+			}
+		}
+		total++
+		if len(results) < limit {
+			msg.Revisions = nil
+			results = append(results, gin.H{
+				"message": msg,
+				"snippet": highlightSnippet(msg.Content, query),
+				"score":   hit.Score,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"query":   query,
+		"results": results,
+		"count":   len(results),
+		"total":   total,
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		forQuery bool
+		want     []string
+	}{
+		{
+			name: "中文同时切成单字和bigram",
+			text: "保修期",
+			want: []string{"保", "修", "期", "保修", "修期"},
+		},
+		{
+			name:     "查询多个字只用bigram",
+			text:     "保修期",
+			forQuery: true,
+			want:     []string{"保修", "修期"},
+		},
+		{
+			name:     "查询单个字用单字",
+			text:     "修",
+			forQuery: true,
+			want:     []string{"修"},
+		},
+		{
+			name: "英文和数字按单词切分并转小写",
+			text: "Order ID: AB-123",
+			want: []string{"order", "id", "ab", "123"},
+		},
+		{
+			name: "中英文混排时分别切分",
+			text: "iPhone15保修",
+			want: []string{"iphone15", "保", "修", "保修"},
+		},
+		{
+			name:     "标点把中文分成多段，不跨段组成bigram",
+			text:     "退货，换货",
+			forQuery: true,
+			want:     []string{"退货", "换货"},
+		},
+		{
+			name:     "单字段和多字段混合查询",
+			text:     "修 保修",
+			forQuery: true,
+			want:     []string{"修", "保修"},
+		},
+		{
+			name: "日文假名和韩文按CJK处理",
+			text: "カナ한글",
+			want: []string{"カ", "ナ", "한", "글", "カナ", "ナ한", "한글"},
+		},
+		{
+			name: "只有标点和空格",
+			text: " ，。!? ",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenize(tt.text, tt.forQuery); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize(%q, %v) = %q，期望 %q", tt.text, tt.forQuery, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	idx := newSearchIndex()
+	idx.Rebuild([]Message{
+		{ID: "01", Content: "手机保修一年，屏幕不保修"},
+		{ID: "02", Content: "保修期内免费维修"},
+		{ID: "03", Content: "退货请联系客服", Tags: []string{"售后"}},
+		{ID: "04", Content: "已删除的保修消息", DeletedAt: "2025-01-01 00:00:00"},
+		{ID: "05", Content: "Order #A123 shipped"},
+	})
+
+	ids := func(hits []searchHit) []string {
+		var result []string
+		for _, hit := range hits {
+			result = append(result, hit.ID)
+		}
+		return result
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"保修", []string{"01", "02"}}, // 01 出现两次，得分更高
+		{"保修期", []string{"02"}},
+		{"修", []string{"02", "01"}}, // 得分相同时较新的消息在前
+		{"保修 免费", []string{"02"}},
+		{"售后", []string{"03"}}, // 标签也会被索引
+		{"order a123", []string{"05"}},
+		{"ORDER", []string{"05"}},
+		{"删除", nil},
+		{"不存在", nil},
+		{"，", nil},
+	}
+	for _, tt := range tests {
+		if got := ids(idx.Search(tt.query)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q) = %v，期望 %v", tt.query, got, tt.want)
+		}
+	}
+
+	// 编辑后旧内容不再命中，删除后不再出现
+	idx.Put(Message{ID: "02", Content: "七天无理由退货"})
+	if got := ids(idx.Search("保修")); !reflect.DeepEqual(got, []string{"01"}) {
+		t.Errorf("编辑后 Search(保修) = %v，期望 [01]", got)
+	}
+	idx.Remove("01")
+	if got := ids(idx.Search("保修")); got != nil {
+		t.Errorf("删除后 Search(保修) = %v，期望为空", got)
+	}
+	if got := ids(idx.Search("退货")); !reflect.DeepEqual(got, []string{"03", "02"}) {
+		t.Errorf("Search(退货) = %v，期望 [03 02]", got)
+	}
+}
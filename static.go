@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 静态资源服务：在 http.ServeContent 的 Range / If-Modified-Since 支持之上，
+// 增加基于内容哈希的 ETag，让手机端刷新页面时可以直接拿到 304
+
+type staticETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+type staticServer struct {
+	root  http.FileSystem
+	mu    sync.Mutex
+	etags map[string]staticETag // 按路径缓存，文件修改时间或大小变化后重新计算
+}
+
+func newStaticServer(dir string) *staticServer {
+	return &staticServer{root: http.Dir(dir), etags: make(map[string]staticETag)}
+}
+
+func (s *staticServer) etagFor(name string, f http.File, modTime time.Time, size int64) (string, error) {
+	s.mu.Lock()
+	cached, ok := s.etags[name]
+	s.mu.Unlock()
+	if ok && cached.modTime.Equal(modTime) && cached.size == size {
+		return cached.etag, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil))[:32] + `"`
+
+	s.mu.Lock()
+	s.etags[name] = staticETag{modTime: modTime, size: size, etag: etag}
+	s.mu.Unlock()
+	return etag, nil
+}
+
+func (s *staticServer) Handle(c *gin.Context) {
+	name := path.Clean("/" + strings.TrimPrefix(c.Param("filepath"), "/"))
+
+	f, err := s.root.Open(name)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	etag, err := s.etagFor(name, f, stat.ModTime(), stat.Size())
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	http.ServeContent(c.Writer, c.Request, stat.Name(), stat.ModTime(), f)
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 存储层：消息和模板都常驻内存，所有修改串行执行，并以原子方式写回磁盘
+
+var (
+	errCategoryNotFound  = errors.New("分类不存在")
+	errDuplicateTemplate = errors.New("模板内容已存在")
+)
+
+// 原子写文件：先写同目录下的临时文件并 fsync，再重命名覆盖目标文件，
+// 避免写到一半断电导致数据文件损坏
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // 重命名成功后此调用无效果
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	// 同步目录项，确保重命名本身落盘（部分平台不支持，忽略错误）
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// MessageStore 消息存储，messages 按最新在前排列。
+// 修改先追加到日志，再更新内存；快照由 Compact 定期写入。
+// 删除的消息先移入回收站（设置 DeletedAt，仍保存在 messages 中），
+// 超过保留期后由 StartTrashPurger 彻底删除。
+// index 是未删除消息的全文索引，随每次修改同步更新
+type MessageStore struct {
+	mu       sync.RWMutex
+	path     string // 快照文件
+	messages []Message
+	journal  *messageJournal
+	index    *searchIndex
+}
+
+func newMessageStore(path, journalPath string) (*MessageStore, error) {
+	// 快照（兼容旧的管道格式和JSON数组格式）
+	messages, err := loadMessages(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// 重放上次压缩之后的日志
+	entries, err := readJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		messages = replayJournal(messages, entries)
+		log.Printf("✅ 已重放 %d 条消息日志", len(entries))
+	}
+
+	journal, err := openMessageJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MessageStore{path: path, messages: messages, journal: journal, index: newSearchIndex()}
+	s.index.Rebuild(messages)
+	if len(entries) > 0 {
+		if err := s.Compact(); err != nil {
+			log.Printf("⚠️ 启动时压缩消息日志失败: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// 返回全部消息（不含回收站）的副本
+func (s *MessageStore) List() []Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	messages := make([]Message, 0, len(s.messages))
+	for _, msg := range s.messages {
+		if msg.DeletedAt == "" {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// 全文搜索未删除的消息，返回按相关度排列的命中结果。
+// 在同一次加锁中按ID查出所有命中的消息，避免逐条线性查找
+func (s *MessageStore) Search(query string) []searchHit {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hits := s.index.Search(query)
+	if len(hits) == 0 {
+		return hits
+	}
+	positions := make(map[string]int, len(s.messages))
+	for i, msg := range s.messages {
+		if msg.DeletedAt == "" {
+			positions[msg.ID] = i
+		}
+	}
+	resolved := hits[:0]
+	for _, hit := range hits {
+		if i, ok := positions[hit.ID]; ok {
+			hit.Message = s.messages[i]
+			resolved = append(resolved, hit)
+		}
+	}
+	return resolved
+}
+
+// 回收站中的消息，最近删除的在前
+func (s *MessageStore) Trash() []Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trashed := []Message{}
+	for _, msg := range s.messages {
+		if msg.DeletedAt != "" {
+			trashed = append(trashed, msg)
+		}
+	}
+	sort.SliceStable(trashed, func(i, j int) bool { return trashed[i].DeletedAt > trashed[j].DeletedAt })
+	return trashed
+}
+
+func (s *MessageStore) Get(id string) (Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i := s.indexLocked(id, false); i >= 0 {
+		return s.messages[i], true
+	}
+	return Message{}, false
+}
+
+// 回收站中的消息
+func (s *MessageStore) GetTrashed(id string) (Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i := s.indexLocked(id, true); i >= 0 {
+		return s.messages[i], true
+	}
+	return Message{}, false
+}
+
+// 查找消息下标，inTrash 为 true 时只找回收站中的消息，否则只找未删除的消息
+func (s *MessageStore) indexLocked(id string, inTrash bool) int {
+	for i, msg := range s.messages {
+		if msg.ID == id && (msg.DeletedAt != "") == inTrash {
+			return i
+		}
+	}
+	return -1
+}
+
+// 新消息插入到最前面并持久化
+func (s *MessageStore) Add(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.journal.Append(journalEntry{Op: journalOpAdd, ID: msg.ID, Message: &msg}); err != nil {
+		return err
+	}
+
+	messages := make([]Message, 0, len(s.messages)+1)
+	messages = append(messages, msg)
+	messages = append(messages, s.messages...)
+	s.messages = messages
+	s.index.Put(msg)
+	s.compactIfNeededLocked()
+	return nil
+}
+
+// 修改指定消息并持久化（记为一条 edit 日志），fn 返回错误时不做任何修改
+func (s *MessageStore) Update(id string, fn func(*Message) error) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateLocked(s.indexLocked(id, false), fn)
+}
+
+func (s *MessageStore) updateLocked(index int, fn func(*Message) error) (Message, error) {
+	if index == -1 {
+		return Message{}, errMessageNotFound
+	}
+
+	updated := s.messages[index]
+	updated.Targets = append([]string(nil), updated.Targets...)
+	updated.Revisions = append([]MessageRevision(nil), updated.Revisions...)
+	updated.Tags = append([]string(nil), updated.Tags...)
+	updated.ExplicitTags = append([]string(nil), updated.ExplicitTags...)
+	if err := fn(&updated); err != nil {
+		return Message{}, err
+	}
+	if err := s.journal.Append(journalEntry{Op: journalOpEdit, ID: updated.ID, Message: &updated}); err != nil {
+		return Message{}, err
+	}
+
+	s.messages[index] = updated
+	s.index.Put(updated)
+	s.compactIfNeededLocked()
+	return updated, nil
+}
+
+// 把消息移入回收站。id为空时按时间戳删除第一条匹配的消息。
+// 只能删除 deviceID 可见的消息（定向消息只有发送者和目标设备可以删除）
+func (s *MessageStore) MoveToTrash(id, timestamp, deviceID string) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := -1
+	for i, msg := range s.messages {
+		if msg.DeletedAt != "" || !visibleTo(msg.Targets, msg.SenderDevice, deviceID) {
+			continue
+		}
+		if (id != "" && msg.ID == id) || (id == "" && msg.Time == timestamp) {
+			index = i
+			break
+		}
+	}
+	return s.updateLocked(index, func(msg *Message) error {
+		msg.DeletedAt = time.Now().In(time.Local).Format("2006-01-02 15:04:05")
+		msg.DeletedBy = deviceID
+		msg.DeletedByName = devices.Name(deviceID)
+		return nil
+	})
+}
+
+// 从回收站恢复消息
+func (s *MessageStore) Restore(id string) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.updateLocked(s.indexLocked(id, true), func(msg *Message) error {
+		msg.DeletedAt = ""
+		msg.DeletedBy = ""
+		msg.DeletedByName = ""
+		return nil
+	})
+}
+
+// 彻底删除回收站中的消息
+func (s *MessageStore) Purge(id string) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.purgeLocked(s.indexLocked(id, true))
+}
+
+// 彻底删除在回收站中超过 retention 的消息
+func (s *MessageStore) PurgeExpired(retention time.Duration) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+	var purged []Message
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		msg := s.messages[i]
+		if msg.DeletedAt == "" {
+			continue
+		}
+		deletedAt, err := time.ParseInLocation("2006-01-02 15:04:05", msg.DeletedAt, time.Local)
+		if err != nil || deletedAt.After(cutoff) {
+			continue
+		}
+		if _, err := s.purgeLocked(i); err != nil {
+			log.Printf("⚠️ 清理回收站失败: %v", err)
+			break
+		}
+		purged = append(purged, msg)
+	}
+	return purged
+}
+
+func (s *MessageStore) purgeLocked(index int) (Message, error) {
+	if index == -1 {
+		return Message{}, errMessageNotFound
+	}
+
+	deleted := s.messages[index]
+	if err := s.journal.Append(journalEntry{Op: journalOpDelete, ID: deleted.ID}); err != nil {
+		return Message{}, err
+	}
+
+	messages := make([]Message, 0, len(s.messages)-1)
+	messages = append(messages, s.messages[:index]...)
+	messages = append(messages, s.messages[index+1:]...)
+	s.messages = messages
+	s.index.Remove(deleted.ID)
+	s.compactIfNeededLocked()
+	return deleted, nil
+}
+
+// 把当前消息写入快照并清空日志
+func (s *MessageStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+func (s *MessageStore) compactLocked() error {
+	if err := saveMessages(s.path, s.messages); err != nil {
+		return err
+	}
+	return s.journal.Reset()
+}
+
+// 关闭日志文件，之后的修改都会失败（房间被删除时调用）
+func (s *MessageStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.journal.Close()
+}
+
+func (s *MessageStore) compactIfNeededLocked() {
+	if s.journal.Len() < journalCompactThreshold {
+		return
+	}
+	if err := s.compactLocked(); err != nil {
+		log.Printf("⚠️ 压缩消息日志失败: %v", err)
+		return
+	}
+	log.Printf("✅ 消息日志已压缩为快照")
+}
+
+// 后台定期压缩，只在有新日志时写快照，done 关闭后退出
+func (s *MessageStore) StartCompactor(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if s.journal.Len() == 0 {
+				continue
+			}
+			if err := s.Compact(); err != nil {
+				log.Printf("⚠️ 定期压缩消息日志失败: %v", err)
+			}
+		}
+	}()
+}
+
+// 按保留策略彻底删除消息：到了 ExpiresAt 的消息（含回收站中的），
+// 早于 maxAge 的消息，以及超出最新 maxCount 条之外的消息。maxCount、maxAge 为 0 表示不限制。
+// 置顶消息不计入条数，也不按天数删除
+func (s *MessageStore) Expire(maxCount int, maxAge time.Duration) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var expired []Message
+	live := 0
+	for i := 0; i < len(s.messages); {
+		msg := s.messages[i]
+		if !messageExpired(msg, now, maxAge, maxCount > 0 && msg.DeletedAt == "" && !msg.Pinned && live >= maxCount) {
+			if msg.DeletedAt == "" && !msg.Pinned {
+				live++
+			}
+			i++
+			continue
+		}
+		if _, err := s.purgeLocked(i); err != nil {
+			log.Printf("⚠️ 清理过期消息失败: %v", err)
+			break
+		}
+		expired = append(expired, msg)
+	}
+	return expired
+}
+
+// 判断消息是否应按保留策略删除，overCount 表示已超出条数限制
+func messageExpired(msg Message, now time.Time, maxAge time.Duration, overCount bool) bool {
+	if overCount {
+		return true
+	}
+	if msg.ExpiresAt != "" {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", msg.ExpiresAt, time.Local); err == nil && !t.After(now) {
+			return true
+		}
+	}
+	if maxAge > 0 && msg.DeletedAt == "" && !msg.Pinned {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", msg.Time, time.Local); err == nil && t.Before(now.Add(-maxAge)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 后台定期彻底删除回收站中过期的消息，done 关闭后退出
+func (s *MessageStore) StartTrashPurger(retention, interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if purged := s.PurgeExpired(retention); len(purged) > 0 {
+				log.Printf("🧹 已清理回收站中过期的 %d 条消息", len(purged))
+			}
+		}
+	}()
+}
+
+// TemplateStore 模板存储
+type TemplateStore struct {
+	mu     sync.RWMutex
+	path   string
+	config TemplatesConfig
+}
+
+func newTemplateStore(path string) (*TemplateStore, error) {
+	config, err := loadTemplates(path)
+	if err != nil {
+		return nil, err
+	}
+	if config.Categories == nil {
+		config.Categories = make(map[string]Category)
+	}
+	return &TemplateStore{path: path, config: config}, nil
+}
+
+// 返回模板配置的深拷贝，调用方可以随意修改
+func (s *TemplateStore) Get() TemplatesConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return cloneTemplatesConfig(s.config)
+}
+
+// 整体替换模板配置
+func (s *TemplateStore) Replace(config TemplatesConfig) error {
+	return s.Update(func(current *TemplatesConfig) error {
+		*current = cloneTemplatesConfig(config)
+		return nil
+	})
+}
+
+// 串行执行"读取-修改-保存"。fn 返回错误时放弃修改，不写盘
+func (s *TemplateStore) Update(fn func(config *TemplatesConfig) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config := cloneTemplatesConfig(s.config)
+	if err := fn(&config); err != nil {
+		return err
+	}
+	if config.Categories == nil {
+		config.Categories = make(map[string]Category)
+	}
+	if err := saveTemplates(s.path, config); err != nil {
+		return err
+	}
+	s.config = config
+	return nil
+}
+
+func cloneTemplatesConfig(config TemplatesConfig) TemplatesConfig {
+	clone := TemplatesConfig{Categories: make(map[string]Category, len(config.Categories))}
+	for key, category := range config.Categories {
+		templates := make([]Template, len(category.Templates))
+		copy(templates, category.Templates)
+		category.Templates = templates
+		clone.Categories[key] = category
+	}
+	return clone
+}
+
+// 编码后原子写入，供 saveMessages / saveTemplates 使用
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
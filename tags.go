@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 消息标签：发送时可以显式指定，也可以直接在内容里写 #标签。
+// 标签统一去掉 # 并把英文转为小写；显式指定的标签单独保存，编辑内容时只重新解析内容中的标签。
+
+const (
+	maxTagsPerMessage = 10
+	maxTagLength      = 20
+)
+
+// # 前面必须是开头或非单词字符，避免把网址片段、C# 之类当成标签
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_/&])#([\p{L}\p{N}_-]+)`)
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// 规范化标签：去掉 #，英文转小写，只保留字母、数字、下划线和连字符
+func normalizeTag(tag string) string {
+	runes := make([]rune, 0, len(tag))
+	for _, r := range strings.ToLower(tag) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' {
+			runes = append(runes, r)
+		}
+	}
+	if len(runes) > maxTagLength {
+		runes = runes[:maxTagLength]
+	}
+	return string(runes)
+}
+
+// 从内容中解析 #标签
+func parseHashtags(content string) []string {
+	var tags []string
+	for _, m := range hashtagPattern.FindAllStringSubmatch(content, -1) {
+		tags = append(tags, m[1])
+	}
+	return tags
+}
+
+// 整理标签列表：支持逗号或空格分隔，规范化后去重，最多 maxTagsPerMessage 个
+func normalizeTags(lists ...[]string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, value := range list {
+			for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '，' || r == ' ' }) {
+				tag = normalizeTag(tag)
+				if tag == "" || seen[tag] {
+					continue
+				}
+				if len(tags) == maxTagsPerMessage {
+					return tags
+				}
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// 消息的全部标签：显式标签加上内容中的 #标签
+func messageTags(explicit []string, content string) []string {
+	return normalizeTags(explicit, parseHashtags(content))
+}
+
+// 消息的显式标签。之前版本保存的消息没有单独记录显式标签，
+// 只能从全部标签中去掉旧内容里的 #标签推算
+func explicitTags(msg Message) []string {
+	if len(msg.ExplicitTags) > 0 {
+		return msg.ExplicitTags
+	}
+	parsed := make(map[string]bool)
+	for _, tag := range normalizeTags(parseHashtags(msg.Content)) {
+		parsed[tag] = true
+	}
+	var tags []string
+	for _, tag := range msg.Tags {
+		if !parsed[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func hasTag(msg Message, tag string) bool {
+	for _, t := range msg.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// 统计标签出现次数，次数多的在前
+func tagCloud(messages []Message) []TagCount {
+	counts := make(map[string]int)
+	for _, msg := range messages {
+		for _, tag := range msg.Tags {
+			counts[tag]++
+		}
+	}
+	cloud := make([]TagCount, 0, len(counts))
+	for tag, n := range counts {
+		cloud = append(cloud, TagCount{Tag: tag, Count: n})
+	}
+	sort.Slice(cloud, func(i, j int) bool {
+		if cloud[i].Count != cloud[j].Count {
+			return cloud[i].Count > cloud[j].Count
+		}
+		return cloud[i].Tag < cloud[j].Tag
+	})
+	return cloud
+}
+
+// 设置消息的显式标签（内容中的 #标签始终保留）并广播
+func (room *Room) setMessageTags(messageID string, tags []string) (Message, error) {
+	updated, err := room.messages.Update(messageID, func(msg *Message) error {
+		msg.ExplicitTags = normalizeTags(tags)
+		msg.Tags = messageTags(msg.ExplicitTags, msg.Content)
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, errMessageNotFound) {
+			log.Printf("❌ 保存消息失败: %v", err)
+		}
+		return Message{}, err
+	}
+
+	room.sendToDevices("message_tags", map[string]interface{}{
+		"id":            updated.ID,
+		"tags":          updated.Tags,
+		"explicit_tags": updated.ExplicitTags,
+		"action":        "tags",
+	}, updated.SenderDevice, updated.Targets)
+	log.Printf("✅ 消息标签已广播: %s %v", updated.ID, updated.Tags)
+
+	return updated, nil
+}
+
+// 标签云：当前设备可见消息中的所有标签及出现次数
+func listTagsHandler(c *gin.Context) {
+	room := roomFrom(c)
+	cloud := tagCloud(visibleMessages(room.messages.List(), requestDeviceID(c)))
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"tags":    cloud,
+		"count":   len(cloud),
+	})
+}
+
+// 修改消息标签
+func setMessageTagsAPIHandler(c *gin.Context) {
+	if !requireRole(c, RoleSender, "修改消息标签") {
+		return
+	}
+	room := roomFrom(c)
+	var requestData struct {
+		Tags []string `json:"tags"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "请求数据格式错误"})
+		return
+	}
+
+	msg, ok := room.messages.Get(c.Param("id"))
+	if !ok || !visibleTo(msg.Targets, msg.SenderDevice, requestDeviceID(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+		return
+	}
+
+	updated, err := room.setMessageTags(msg.ID, requestData.Tags)
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "消息不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "保存消息失败"})
+		return
+	}
+
+	updated.Revisions = nil
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": updated})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 模板搜索：标题和内容可以用中文原文、全拼（baoxiu）、首字母（bx）
+// 或两者混合（baox、bxiu）搜索，不区分大小写，忽略空格和标点。
+// 汉字拼音表 pinyin.txt 编译进程序，不依赖网络；多音字的每个读音都能匹配。
+
+//go:embed pinyin.txt
+var pinyinData string
+
+const (
+	defaultTemplateSearchLimit = 20
+	maxTemplateSearchLimit     = 100
+)
+
+// 匹配方式，数值越大越靠前
+const (
+	templateMatchInitials = iota + 1 // 首字母或首字母与全拼混合
+	templateMatchPinyin              // 全拼
+	templateMatchText                // 原文
+)
+
+var templateMatchNames = map[int]string{
+	templateMatchInitials: "initials",
+	templateMatchPinyin:   "pinyin",
+	templateMatchText:     "text",
+}
+
+var (
+	pinyinOnce  sync.Once
+	pinyinTable map[rune][]string
+)
+
+// 汉字的所有读音（不带声调，ü 写作 v），不是汉字或不在表中时返回 nil
+func pinyinOf(r rune) []string {
+	pinyinOnce.Do(func() {
+		pinyinTable = make(map[rune][]string)
+		for _, line := range strings.Split(pinyinData, "\n") {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			syllable, chars, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			for _, ch := range chars {
+				pinyinTable[ch] = append(pinyinTable[ch], syllable)
+			}
+		}
+	})
+	return pinyinTable[r]
+}
+
+// 拼音匹配的单位：一个汉字（可能有多个读音）或一个字母/数字
+type pinyinUnit struct {
+	readings []string
+}
+
+// 把文本转换为拼音匹配单位，空格和标点被跳过
+func pinyinUnits(text string) []pinyinUnit {
+	units := make([]pinyinUnit, 0, len(text))
+	for _, r := range text {
+		if readings := pinyinOf(r); readings != nil {
+			units = append(units, pinyinUnit{readings: readings})
+			continue
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			units = append(units, pinyinUnit{readings: []string{string(unicode.ToLower(r))}})
+		}
+	}
+	return units
+}
+
+// 整理拼音查询：转小写，去掉空格和标点，ü 转为 v
+func normalizePinyinQuery(query string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(query) {
+		switch {
+		case r == 'ü':
+			b.WriteRune('v')
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// 在 units 中查找能连续拼出 query 的位置，返回最好的匹配方式和起始单位下标；
+// 每个字可以取完整读音或读音的前缀（至少一个字母），只有最后一个字允许只取前缀而不算缩写
+func matchPinyin(units []pinyinUnit, query string) (kind, start int) {
+	if query == "" {
+		return 0, -1
+	}
+
+	// memo[{i, j}]：从第 i 个单位、查询第 j 个字符开始能得到的最好匹配方式
+	memo := make(map[[2]int]int)
+	var match func(i, j int) int
+	match = func(i, j int) int {
+		if j == len(query) {
+			return templateMatchPinyin
+		}
+		if i == len(units) {
+			return 0
+		}
+		key := [2]int{i, j}
+		if v, ok := memo[key]; ok {
+			return v
+		}
+		best := 0
+		for _, reading := range units[i].readings {
+			for k := 1; k <= len(reading) && j+k <= len(query); k++ {
+				if query[j+k-1] != reading[k-1] {
+					break
+				}
+				var result int
+				if j+k == len(query) {
+					result = templateMatchPinyin // 最后一个字可以只输入一部分
+				} else {
+					result = match(i+1, j+k)
+					if result != 0 && k < len(reading) {
+						result = templateMatchInitials
+					}
+				}
+				best = max(best, result)
+			}
+		}
+		memo[key] = best
+		return best
+	}
+
+	start = -1
+	for i := range units {
+		if result := match(i, 0); result > kind {
+			kind, start = result, i
+			if kind == templateMatchPinyin {
+				break
+			}
+		}
+	}
+	return kind, start
+}
+
+// 计算文本与查询的匹配方式和匹配位置是否在开头
+func matchTemplateText(text, query, pinyinQuery string) (kind int, atStart bool) {
+	if i := strings.Index(strings.ToLower(text), strings.ToLower(query)); i >= 0 {
+		return templateMatchText, i == 0
+	}
+	if pinyinQuery == "" {
+		return 0, false
+	}
+	kind, start := matchPinyin(pinyinUnits(text), pinyinQuery)
+	return kind, start == 0
+}
+
+type templateSearchResult struct {
+	CategoryKey  string  `json:"category_key"`
+	CategoryName string  `json:"category_name"`
+	CategoryIcon string  `json:"category_icon"`
+	Index        int     `json:"index"`
+	Title        string  `json:"title"`
+	Content      string  `json:"content"`
+	Field        string  `json:"field"` // title / content
+	Match        string  `json:"match"` // text / pinyin / initials
+	Score        float64 `json:"score"`
+}
+
+// 打分：原文 > 全拼 > 首字母，标题 > 内容，开头匹配和短标题略微靠前
+func scoreTemplate(kind int, inTitle, atStart bool, title string) float64 {
+	score := float64(kind) * 100
+	if inTitle {
+		score += 50
+	}
+	if atStart {
+		score += 20
+	}
+	return score + 10/float64(len([]rune(title))+1)
+}
+
+func searchTemplates(config TemplatesConfig, query string) []templateSearchResult {
+	pinyinQuery := normalizePinyinQuery(query)
+	results := []templateSearchResult{}
+	for key, category := range config.Categories {
+		for i, t := range category.Templates {
+			result := templateSearchResult{
+				CategoryKey:  key,
+				CategoryName: category.Name,
+				CategoryIcon: category.Icon,
+				Index:        i,
+				Title:        t.Title,
+				Content:      t.Content,
+			}
+			if kind, atStart := matchTemplateText(t.Title, query, pinyinQuery); kind > 0 {
+				result.Field = "title"
+				result.Match = templateMatchNames[kind]
+				result.Score = scoreTemplate(kind, true, atStart, t.Title)
+			}
+			if kind, atStart := matchTemplateText(t.Content, query, pinyinQuery); kind > 0 {
+				if score := scoreTemplate(kind, false, atStart, t.Title); score > result.Score {
+					result.Field = "content"
+					result.Match = templateMatchNames[kind]
+					result.Score = score
+				}
+			}
+			if result.Score > 0 {
+				results = append(results, result)
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].CategoryKey != results[j].CategoryKey {
+			return results[i].CategoryKey < results[j].CategoryKey
+		}
+		return results[i].Index < results[j].Index
+	})
+	return results
+}
+
+// 搜索模板：q 可以是中文、全拼或拼音首字母
+func searchTemplatesHandler(c *gin.Context) {
+	room := roomFrom(c)
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "缺少搜索关键词"})
+		return
+	}
+
+	limit := defaultTemplateSearchLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "limit 参数无效"})
+			return
+		}
+		limit = min(n, maxTemplateSearchLimit)
+	}
+
+	results := searchTemplates(room.templates.Get(), query)
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"query":   query,
+		"results": results,
+		"count":   len(results),
+		"total":   total,
+	})
+}
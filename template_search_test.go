@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestPinyinOf(t *testing.T) {
+	tests := []struct {
+		r    rune
+		want []string
+	}{
+		{'保', []string{"bao"}},
+		{'行', []string{"hang", "xing"}},
+		{'长', []string{"chang", "zhang"}},
+		{'重', []string{"chong", "zhong"}},
+		{'a', nil},
+		{'，', nil},
+	}
+	for _, tt := range tests {
+		if got := pinyinOf(tt.r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pinyinOf(%q) = %v，期望 %v", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizePinyinQuery(t *testing.T) {
+	tests := map[string]string{
+		"Bao Xiu": "baoxiu",
+		"b-x!":    "bx",
+		"lü":      "lv",
+		"ABC123":  "abc123",
+		"保修":      "",
+		"":        "",
+	}
+	for query, want := range tests {
+		if got := normalizePinyinQuery(query); got != want {
+			t.Errorf("normalizePinyinQuery(%q) = %q，期望 %q", query, got, want)
+		}
+	}
+}
+
+func TestMatchPinyin(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		query     string
+		wantKind  int
+		wantStart int
+	}{
+		{"首字母", "保修", "bx", templateMatchInitials, 0},
+		{"全拼", "保修", "baoxiu", templateMatchPinyin, 0},
+		{"最后一个字只输入一部分", "保修", "baox", templateMatchPinyin, 0},
+		{"只输入第一个字的一部分", "保修", "ba", templateMatchPinyin, 0},
+		{"首字母与全拼混合", "保修", "bxiu", templateMatchInitials, 0},
+		{"从中间开始匹配", "保修", "xiu", templateMatchPinyin, 1},
+		{"首字母不对", "保修", "bz", 0, -1},
+		{"查询比文本长", "保修", "baoxiux", 0, -1},
+		{"空查询", "保修", "", 0, -1},
+
+		// 多音字的每个读音都能匹配
+		{"多音字读音一", "银行", "yinhang", templateMatchPinyin, 0},
+		{"多音字读音二", "银行", "yinxing", templateMatchPinyin, 0},
+		{"多音字首字母一", "银行", "yh", templateMatchInitials, 0},
+		{"多音字首字母二", "银行", "yx", templateMatchInitials, 0},
+		{"多音字在开头", "长期", "zhangqi", templateMatchPinyin, 0},
+		{"多音字在开头的首字母", "长期", "cq", templateMatchInitials, 0},
+		{"多音字的另一读音", "重庆", "zhongqing", templateMatchPinyin, 0},
+		{"同一个字只取一个读音", "长期", "chzhq", 0, -1},
+		{"说有两个读音", "保修说明", "shuoming", templateMatchPinyin, 2},
+		{"说的首字母", "保修说明", "bxsm", templateMatchInitials, 0},
+
+		// 字母、数字和标点
+		{"英文字母逐个匹配", "iPhone保修", "iphonebx", templateMatchInitials, 0},
+		{"从英文中间匹配", "iPhone保修", "phone", templateMatchPinyin, 1},
+		{"标点被跳过", "保修，退款", "bxtk", templateMatchInitials, 0},
+		{"跨过标点的全拼", "保修，退款", "xiutui", templateMatchPinyin, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, start := matchPinyin(pinyinUnits(tt.text), tt.query)
+			if kind != tt.wantKind || start != tt.wantStart {
+				t.Errorf("matchPinyin(%q, %q) = %d, %d，期望 %d, %d",
+					tt.text, tt.query, kind, start, tt.wantKind, tt.wantStart)
+			}
+		})
+	}
+}
+
+func TestMatchTemplateText(t *testing.T) {
+	tests := []struct {
+		text, query string
+		wantKind    int
+		wantAtStart bool
+	}{
+		{"延长保修", "保修", templateMatchText, false},
+		{"延长保修", "延长", templateMatchText, true},
+		{"iPhone 保修", "IPHONE", templateMatchText, true},
+		{"延长保修", "bx", templateMatchInitials, false},
+		{"延长保修", "yczbx", 0, false},
+		{"延长保修", "yanzhang", templateMatchPinyin, true},
+		{"延长保修", "换货", 0, false},
+	}
+	for _, tt := range tests {
+		kind, atStart := matchTemplateText(tt.text, tt.query, normalizePinyinQuery(tt.query))
+		if kind != tt.wantKind || atStart != tt.wantAtStart {
+			t.Errorf("matchTemplateText(%q, %q) = %d, %v，期望 %d, %v",
+				tt.text, tt.query, kind, atStart, tt.wantKind, tt.wantAtStart)
+		}
+	}
+}
+
+func TestSearchTemplates(t *testing.T) {
+	config := TemplatesConfig{Categories: map[string]Category{
+		"after_sales": {Name: "售后", Templates: []Template{
+			{Title: "退货说明", Content: "七天内可申请退货，保修期内免费维修"},
+			{Title: "保修政策", Content: "整机保修一年"},
+		}},
+		"bank": {Name: "银行", Templates: []Template{
+			{Title: "银行账户", Content: "请转账到以下账户"},
+		}},
+	}}
+
+	tests := []struct {
+		query string
+		want  []string // 分类:下标:字段:匹配方式
+	}{
+		{"bx", []string{"after_sales:1:title:initials", "after_sales:0:content:initials"}},
+		{"保修", []string{"after_sales:1:title:text", "after_sales:0:content:text"}},
+		{"yinxing", []string{"bank:0:title:pinyin"}},
+		{"zz", []string{"bank:0:content:initials"}}, // 转账 zhuan zhang
+		{"vv", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range searchTemplates(config, tt.query) {
+			got = append(got, r.CategoryKey+":"+strconv.Itoa(r.Index)+":"+r.Field+":"+r.Match)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTemplates(%q) = %v，期望 %v", tt.query, got, tt.want)
+		}
+	}
+}